@@ -0,0 +1,232 @@
+package main
+
+// This keeps track of check-ins from updaters, so that we can see which sites
+// are running which release.
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/IMQS/updater/updater"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxCheckinBytes = 1024 * 1024
+const maxCheckinDirs = 100
+const maxMachineIDLength = 200
+
+// Machine status, as reported by the fleet listing
+const (
+	statusOK        = "ok"        // All dirs are on the latest release
+	statusStraggler = "straggler" // At least one dir is not on the latest release
+	statusFailing   = "failing"   // The last check-in reported an error
+	statusSilent    = "silent"    // The machine has not checked in for a long time
+)
+
+// The most recent check-in from a machine
+type fleetMachine struct {
+	LastSeen time.Time // Server time when the check-in was received
+	Checkin  updater.Checkin
+}
+
+// A machine, as reported by the fleet listing
+type fleetEntry struct {
+	MachineID string
+	Hostname  string
+	Version   string
+	LastSeen  time.Time
+	LastError string
+	Status    string
+	Dirs      []fleetDir
+}
+
+type fleetDir struct {
+	updater.CheckinDir
+	LatestHash string // manifest.hash currently being served for RemotePath
+	UpToDate   bool   // True if CurrentHash equals LatestHash
+	Unknown    bool   // RemotePath is not one that we serve (eg an s3:// URL), so we can't tell whether it is up to date
+}
+
+// All machines that have ever checked in. This is persisted to a JSON file after every check-in.
+type fleet struct {
+	filename    string
+	root        string // Root of the files that we serve, so that we can find the latest manifest.hash of each remote path
+	token       string // If not empty, then check-ins must carry this bearer token
+	silentAfter time.Duration
+	lock        sync.Mutex
+	machines    map[string]*fleetMachine
+}
+
+func openFleet(filename, root string) (*fleet, error) {
+	f := &fleet{
+		filename: filename,
+		root:     root,
+		machines: map[string]*fleetMachine{},
+	}
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &f.machines); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write to a temporary file and rename, so that a crash never leaves us with a half-written file
+func (f *fleet) save() error {
+	raw, err := json.MarshalIndent(f.machines, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := f.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.filename)
+}
+
+func (f *fleet) handleCheckin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if f.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+f.token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	c := updater.Checkin{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCheckinBytes)).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateCheckin(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.machines[c.MachineID] = &fleetMachine{
+		LastSeen: time.Now().UTC(),
+		Checkin:  c,
+	}
+	if err := f.save(); err != nil {
+		log.Printf("Failed to save fleet: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reject check-ins that no updater would send, so that the fleet listing stays readable
+func validateCheckin(c *updater.Checkin) error {
+	if c.MachineID == "" {
+		return errors.New("MachineID is required")
+	}
+	if len(c.MachineID) > maxMachineIDLength || strings.IndexFunc(c.MachineID, func(r rune) bool { return r < ' ' }) != -1 {
+		return errors.New("Invalid MachineID")
+	}
+	if len(c.Dirs) > maxCheckinDirs {
+		return errors.New("Too many dirs")
+	}
+	for _, d := range c.Dirs {
+		if !isHashOrEmpty(d.CurrentHash) || !isHashOrEmpty(d.StagedHash) {
+			return errors.New("Invalid hash for " + d.LocalPath)
+		}
+	}
+	return nil
+}
+
+func isHashOrEmpty(s string) bool {
+	raw, err := hex.DecodeString(s)
+	return err == nil && (len(raw) == 0 || len(raw) == 32)
+}
+
+func (f *fleet) handleFleet(w http.ResponseWriter, r *http.Request) {
+	onlyProblems := r.URL.Query().Get("problems") != ""
+
+	f.lock.Lock()
+	entries := []*fleetEntry{}
+	latest := map[string]string{}
+	now := time.Now().UTC()
+	for _, m := range f.machines {
+		e := f.describe(m, now, latest)
+		if onlyProblems && e.Status == statusOK {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	f.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].MachineID < entries[j].MachineID })
+	w.Header().Set("Content-Type", "application/json")
+	raw, _ := json.MarshalIndent(entries, "", "\t")
+	w.Write(raw)
+}
+
+// Build a fleet listing entry for 'm'. 'latest' caches the latest hash of every remote path.
+func (f *fleet) describe(m *fleetMachine, now time.Time, latest map[string]string) *fleetEntry {
+	e := &fleetEntry{
+		MachineID: m.Checkin.MachineID,
+		Hostname:  m.Checkin.Hostname,
+		Version:   m.Checkin.Version,
+		LastSeen:  m.LastSeen,
+		LastError: m.Checkin.LastError,
+		Status:    statusOK,
+	}
+	for _, d := range m.Checkin.Dirs {
+		if !updater.IsRelativeRemotePath(d.RemotePath) {
+			e.Dirs = append(e.Dirs, fleetDir{
+				CheckinDir: d,
+				Unknown:    true,
+			})
+			continue
+		}
+		hash, ok := latest[d.RemotePath]
+		if !ok {
+			hash = f.latestHash(d.RemotePath)
+			latest[d.RemotePath] = hash
+		}
+		upToDate := hash != "" && hash == d.CurrentHash
+		e.Dirs = append(e.Dirs, fleetDir{
+			CheckinDir: d,
+			LatestHash: hash,
+			UpToDate:   upToDate,
+		})
+		if !upToDate {
+			e.Status = statusStraggler
+		}
+	}
+	if f.silentAfter > 0 && now.Sub(m.LastSeen) > f.silentAfter {
+		e.Status = statusSilent
+	}
+	if e.LastError != "" {
+		e.Status = statusFailing
+	}
+	return e
+}
+
+// Returns the manifest.hash that we are currently serving for 'remotePath', which must be relative
+// to our root, or an empty string
+func (f *fleet) latestHash(remotePath string) string {
+	// Clean against a rooted path, so that a malicious remote path cannot escape our root
+	clean := path.Clean("/" + remotePath)
+	raw, err := ioutil.ReadFile(filepath.Join(f.root, filepath.FromSlash(clean), updater.ManifestFilename_Hash))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(raw))
+}
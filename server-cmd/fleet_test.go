@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/IMQS/updater/updater"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHashA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+const testHashB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+func newTestFleet(t *testing.T) *fleet {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "files")
+	if err := os.MkdirAll(filepath.Join(root, "imqsbin", "stable"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "imqsbin", "stable", updater.ManifestFilename_Hash), []byte(testHashA), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openFleet(filepath.Join(tmp, "fleet.json"), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func postCheckin(f *fleet, token string, body string) int {
+	req := httptest.NewRequest("POST", "/checkin", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	f.handleCheckin(w, req)
+	return w.Code
+}
+
+func checkinJSON(c *updater.Checkin) string {
+	raw, _ := json.Marshal(c)
+	return string(raw)
+}
+
+func TestHandleCheckin(t *testing.T) {
+	f := newTestFleet(t)
+	f.token = "sesame"
+	good := &updater.Checkin{MachineID: "site-1", Dirs: []updater.CheckinDir{{RemotePath: "imqsbin/stable", CurrentHash: testHashA}}}
+
+	w := httptest.NewRecorder()
+	f.handleCheckin(w, httptest.NewRequest("GET", "/checkin", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be refused, but got %v", w.Code)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if code := postCheckin(f, token, checkinJSON(good)); code != http.StatusUnauthorized {
+			t.Errorf("Expected token '%v' to be refused, but got %v", token, code)
+		}
+	}
+	bad := []*updater.Checkin{
+		{},
+		{MachineID: "site\n1"},
+		{MachineID: "site-1", Dirs: []updater.CheckinDir{{CurrentHash: "not a hash"}}},
+	}
+	for _, c := range bad {
+		if code := postCheckin(f, "sesame", checkinJSON(c)); code != http.StatusBadRequest {
+			t.Errorf("Expected %+v to be refused, but got %v", c, code)
+		}
+	}
+	if code := postCheckin(f, "sesame", "{"); code != http.StatusBadRequest {
+		t.Errorf("Expected invalid JSON to be refused, but got %v", code)
+	}
+	if len(f.machines) != 0 {
+		t.Fatalf("Refused check-ins may not be stored")
+	}
+
+	if code := postCheckin(f, "sesame", checkinJSON(good)); code != http.StatusNoContent {
+		t.Fatalf("Expected the check-in to be accepted, but got %v", code)
+	}
+	reopened, err := openFleet(f.filename, f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := reopened.machines["site-1"]; m == nil || m.Checkin.Dirs[0].CurrentHash != testHashA {
+		t.Errorf("Expected the check-in to be saved, but got %+v", reopened.machines)
+	}
+}
+
+func TestFleetListing(t *testing.T) {
+	f := newTestFleet(t)
+	f.silentAfter = time.Hour
+	checkins := []*updater.Checkin{
+		{MachineID: "ok", Dirs: []updater.CheckinDir{{RemotePath: "imqsbin/stable", CurrentHash: testHashA}}},
+		{MachineID: "straggler", Dirs: []updater.CheckinDir{{RemotePath: "imqsbin/stable", CurrentHash: testHashB}}},
+		{MachineID: "failing", LastError: "disk on fire", Dirs: []updater.CheckinDir{{RemotePath: "imqsbin/stable", CurrentHash: testHashA}}},
+		// Remote paths that we don't serve are not judged
+		{MachineID: "elsewhere", Dirs: []updater.CheckinDir{
+			{RemotePath: "s3://bucket/imqsbin", CurrentHash: testHashB},
+			{RemotePath: "c:/deploy/imqsbin", CurrentHash: testHashB},
+			{RemotePath: "file:///srv/imqsbin", CurrentHash: testHashB},
+		}},
+	}
+	for _, c := range checkins {
+		if code := postCheckin(f, "", checkinJSON(c)); code != http.StatusNoContent {
+			t.Fatalf("Check-in of %v failed with %v", c.MachineID, code)
+		}
+	}
+	f.machines["silent"] = &fleetMachine{LastSeen: time.Now().Add(-2 * time.Hour), Checkin: *checkins[0]}
+	f.machines["silent"].Checkin.MachineID = "silent"
+
+	list := func(query string) map[string]*fleetEntry {
+		w := httptest.NewRecorder()
+		f.handleFleet(w, httptest.NewRequest("GET", "/fleet"+query, nil))
+		entries := []*fleetEntry{}
+		if err := json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		byID := map[string]*fleetEntry{}
+		for _, e := range entries {
+			byID[e.MachineID] = e
+		}
+		return byID
+	}
+	all := list("")
+	expect := map[string]string{
+		"ok":        statusOK,
+		"straggler": statusStraggler,
+		"failing":   statusFailing,
+		"elsewhere": statusOK,
+		"silent":    statusSilent,
+	}
+	for id, status := range expect {
+		if e := all[id]; e == nil || e.Status != status {
+			t.Errorf("Expected %v to be %v, but got %+v", id, status, e)
+		}
+	}
+	if d := all["straggler"].Dirs[0]; d.LatestHash != testHashA || d.UpToDate {
+		t.Errorf("Unexpected straggler dir %+v", d)
+	}
+	for _, d := range all["elsewhere"].Dirs {
+		if !d.Unknown || d.LatestHash != "" {
+			t.Errorf("Expected %v to be unknown, but got %+v", d.RemotePath, d)
+		}
+	}
+	problems := list("?problems=1")
+	if len(problems) != 3 || problems["ok"] != nil || problems["elsewhere"] != nil {
+		t.Errorf("Expected only the problems, but got %v", problems)
+	}
+}
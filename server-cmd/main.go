@@ -2,35 +2,72 @@ package main
 
 // Toy server useful when developing. In practice just use nginx, because
 // all we're doing is serving up static content.
+// The one thing that nginx can't do for us is collect check-ins from updaters,
+// so if you want a fleet listing, then route /checkin and /fleet to this server.
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 )
 
+const usageTxt = `commands:
+  serve root-dir   Run an HTTP server, with /files/* serving up root-dir/*
+                   Compressed siblings listed in manifest.compressed are served to clients that accept their encoding
+                   POST /checkin receives check-ins from updaters (with -checkintoken as a bearer token)
+                   GET /fleet lists all machines that have checked in
+                   GET /fleet?problems=1 lists only stragglers and failing machines
+`
+
 func showHelpAndExit() {
-	fmt.Println("commands:")
-	fmt.Println("  serve root-dir   Run an HTTP server, with /files/* serving up root-dir/*")
+	os.Stderr.WriteString(usageTxt)
+	fmt.Fprintf(os.Stderr, "options:\n")
+	flag.PrintDefaults()
 	os.Exit(1)
 }
 
 func main() {
-	if len(os.Args) < 2 {
+	flagAddr := flag.String("addr", ":8080", "Address to listen on")
+	flagFleet := flag.String("fleet", "fleet.json", "File in which check-ins are stored")
+	flagSilentHours := flag.Float64("silenthours", 24, "A machine that has not checked in for this many hours is reported as silent")
+	flagCheckinToken := flag.String("checkintoken", "", "Check-ins must carry this bearer token (the CheckinToken of the updaters). Empty = accept check-ins from anyone")
+	flagPrecompressed := flag.Bool("precompressed", true, "Serve compressed siblings (eg foo.gz or foo.zst for foo) to clients that accept gzip or zstd")
+
+	flag.Usage = showHelpAndExit
+	flag.CommandLine.Parse(os.Args[1:])
+
+	if flag.NArg() < 1 {
 		showHelpAndExit()
 	}
-	switch os.Args[1] {
+	switch flag.Arg(0) {
 	case "serve":
-		if len(os.Args) < 3 {
+		if flag.NArg() < 2 {
 			fmt.Printf("No root-dir specified\n")
 			os.Exit(1)
 		}
-		root := os.Args[2]
-		http.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(root))))
-		log.Fatal(http.ListenAndServe(":8080", nil))
+		root := flag.Arg(1)
+		fleet, err := openFleet(*flagFleet, root)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fleet.silentAfter = time.Duration(*flagSilentHours * float64(time.Hour))
+		fleet.token = *flagCheckinToken
+		if fleet.token == "" {
+			log.Printf("Warning: -checkintoken is not set, so anyone can post check-ins")
+		}
+		var files http.Handler = http.FileServer(http.Dir(root))
+		if *flagPrecompressed {
+			files = newPrecompressedFileServer(root)
+		}
+		http.Handle("/files/", http.StripPrefix("/files/", files))
+		http.HandleFunc("/checkin", fleet.handleCheckin)
+		http.HandleFunc("/fleet", fleet.handleFleet)
+		log.Fatal(http.ListenAndServe(*flagAddr, nil))
 	default:
-		fmt.Printf("Unrecognized command '%v'\n", os.Args[1])
+		fmt.Printf("Unrecognized command '%v'\n", flag.Arg(0))
 		os.Exit(1)
 	}
 }
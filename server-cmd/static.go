@@ -0,0 +1,122 @@
+package main
+
+// This serves up pre-compressed siblings of release files, in the same way as nginx's "gzip_static on",
+// but for every encoding that the updater understands (eg foo.zst in zstd, and foo.gz in gzip).
+// A sibling is only used if it is listed in a manifest.compressed file, in the same directory
+// as the file or in one of its parents. Otherwise a release that happens to contain both
+// foo and foo.gz would be served incorrectly. For the same reason, a sibling whose size differs from
+// the size recorded in manifest.compressed is not used.
+
+import (
+	"github.com/IMQS/updater/updater"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type precompressedFileServer struct {
+	root  string
+	files http.Handler
+	lock  sync.Mutex
+	lists map[string]*compressedList // Key is the directory that holds manifest.compressed
+}
+
+type compressedList struct {
+	modTime time.Time
+	sizes   map[string]int64 // Size of each sibling. -1 if the publisher did not record it.
+}
+
+func newPrecompressedFileServer(root string) *precompressedFileServer {
+	return &precompressedFileServer{
+		root:  root,
+		files: http.FileServer(http.Dir(root)),
+		lists: map[string]*compressedList{},
+	}
+}
+
+func (s *precompressedFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if size, ok := s.compressedSiblingSize(name); ok {
+		for _, encoding := range updater.ContentEncodings() {
+			if acceptsEncoding(r, encoding) && s.serveSibling(w, r, name, encoding, size) {
+				return
+			}
+		}
+	}
+	s.files.ServeHTTP(w, r)
+}
+
+// Serve the sibling of 'name' in 'encoding', if it exists and has the size that was recorded in manifest.compressed
+func (s *precompressedFileServer) serveSibling(w http.ResponseWriter, r *http.Request, name, encoding string, size int64) bool {
+	f, err := os.Open(s.fullPath(name + updater.CompressedExtension(encoding)))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || (size >= 0 && stat.Size() != size) {
+		return false
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, name, stat.ModTime(), f)
+	return true
+}
+
+func (s *precompressedFileServer) fullPath(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+// Look for a manifest.compressed in the directory of 'name', and all of its parents.
+// Returns the size of the sibling, as recorded in manifest.compressed, and true if 'name' has a sibling.
+func (s *precompressedFileServer) compressedSiblingSize(name string) (int64, bool) {
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if list := s.readList(dir); list != nil {
+			rel := strings.TrimPrefix(strings.TrimPrefix(name, dir), "/")
+			size, ok := list.sizes[rel]
+			return size, ok
+		}
+		if dir == "/" {
+			return 0, false
+		}
+	}
+}
+
+// Returns the parsed manifest.compressed inside 'dir', or nil if there is none
+func (s *precompressedFileServer) readList(dir string) *compressedList {
+	filename := s.fullPath(path.Join(dir, updater.ManifestFilename_Compressed))
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if list := s.lists[dir]; list != nil && list.modTime.Equal(stat.ModTime()) {
+		return list
+	}
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	list := &compressedList{
+		modTime: stat.ModTime(),
+		sizes:   updater.ParseCompressedList(raw),
+	}
+	s.lists[dir] = list
+	return list
+}
+
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(part, ";", 2)[0]) == encoding {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/IMQS/updater/updater"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeSiblingInAcceptedEncoding(t *testing.T) {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, "big.txt"), []byte(strings.Repeat("compress me ", 1000)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	m, err := updater.BuildManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := updater.WriteCompressedSiblings(root, m, "zstd"); err != nil {
+		t.Fatal(err)
+	}
+	s := newPrecompressedFileServer(root)
+	for acceptEncoding, expect := range map[string]string{
+		"zstd, gzip": "zstd",
+		"gzip":       "", // The release only has zstd siblings
+		"":           "",
+	} {
+		req := httptest.NewRequest("GET", "/big.txt", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if ce := w.Header().Get("Content-Encoding"); ce != expect {
+			t.Errorf("Accept-Encoding '%v': expected Content-Encoding '%v', but got '%v'", acceptEncoding, expect, ce)
+		}
+	}
+}
@@ -1,23 +1,58 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/IMQS/updater/updater"
+	"net/http"
 	"os"
+	_ "time/tzdata" // Maintenance windows name their timezone, and Windows has no timezone database of its own
 )
 
 const usageTxt = `commands:
-  buildmanifest <dir>  Update manifest in <dir>
+  buildmanifest <dir>  Update manifest in <dir>. With -require, the release is only installed
+                       together with the given releases of other dirs. With -urgent, the release
+                       is installed even outside of maintenance windows.
+  export-bundle <dir> <bundle.tar.gz> [remote-path]
+                       Pack the release in <dir> into an offline bundle.
+                       [remote-path] (eg imqsbin/stable) selects the SyncDir on import.
+  import-bundle <bundle.tar.gz>
+                       Check an offline bundle, and stage it for the next apply
+  diff <A> <B>         List the files and dirs that differ between two releases. A and B can each be
+                       a manifest.content file, a directory, or a remote path (eg a URL).
+                       With -config, relative remote paths and S3 credentials come from the config.
+  verify <dir>         Compare the files in <dir> with the manifest that was installed with them.
+                       Lists modified, missing and extra files, and exits with code 2 if there are any.
+                       With -repair, the release is fetched and installed again.
+  publish-s3 <dir> <s3://bucket/path>
+                       Upload the release in <dir> to S3, using the S3 settings in the config
   run                  Run in foreground (in console)
   service              Run as a Windows Service
+  archive              List the previous releases that are kept for rollback
+  rollback             Install the most recently archived release of every dir (or with -to <hash>,
+                       only that release), and pause automatic updates
+  resume               Resume automatic updates after a rollback
   download             Check for new content, and download
-  apply                If an update is ready to be applied, then do so
+  apply                If an update is ready to be applied, and we are inside a maintenance window,
+                       then do so. With -force, ignore the maintenance windows.
+  plan                 Show what download and apply would do, without changing anything
+  status               Show the current, staged and remote release of every dir, and the state of services.
+                       Exit code: 0 = up to date, 1 = error (eg remote unreachable), 2 = update pending
 `
 
 func main() {
 
 	flagConfig := flag.String("config", "", "JSON config file (must be specified)")
+	flagCompress := flag.Bool("compress", false, "buildmanifest also writes compressed siblings of files that compress well")
+	flagCompression := flag.String("compression", "gzip", "the encoding of the siblings that -compress writes: gzip or zstd (older updaters, and nginx's gzip_static, only understand gzip)")
+	flagJson := flag.Bool("json", false, "diff, plan and status write JSON instead of text")
+	flagRepair := flag.Bool("repair", false, "verify re-installs the release if the installed files have drifted")
+	flagTo := flag.String("to", "", "rollback installs the archived release whose hash starts with this")
+	flagRequire := flag.String("require", "", "buildmanifest records that the release must be installed with these releases of other dirs, as a comma separated list of remotePath=hash (eg imqsconf/stable=9f86d0...). Instead of a hash, a release directory can be given.")
+	flagUrgent := flag.Bool("urgent", false, "buildmanifest marks the release as urgent, so that it is installed right away, even outside of maintenance windows")
+	flagForce := flag.Bool("force", false, "apply ignores maintenance windows")
+	flagChunkMB := flag.Float64("chunkmb", 0, "buildmanifest splits files of at least this many MB into chunks, so that clients can download only the parts that changed (0 = off)")
 
 	flag.Usage = func() {
 		os.Stderr.WriteString(usageTxt)
@@ -65,9 +100,100 @@ func main() {
 		if manifest, err := updater.BuildManifest(root); err != nil {
 			errDie(err)
 		} else {
+			if *flagRequire != "" {
+				if manifest.Requires, err = updater.ParseRequires(*flagRequire); err != nil {
+					errDie(err)
+				}
+			}
+			manifest.Urgent = *flagUrgent
+			if *flagChunkMB > 0 {
+				if err := updater.AddChunks(root, manifest, int64(*flagChunkMB*1024*1024)); err != nil {
+					errDie(err)
+				}
+			}
 			if err := manifest.Write(root); err != nil {
 				errDie(err)
 			}
+			if *flagCompress {
+				err = updater.WriteCompressedSiblings(root, manifest, *flagCompression)
+			} else {
+				err = updater.RemoveCompressedSiblings(root)
+			}
+			if err != nil {
+				errDie(err)
+			}
+		}
+	} else if cmd == "export-bundle" {
+		if len(flag.Args()) != 3 && len(flag.Args()) != 4 {
+			helpDie("export-bundle needs <dir> and <bundle.tar.gz>")
+		}
+		if err := updater.ExportBundle(flag.Arg(1), flag.Arg(2), flag.Arg(3)); err != nil {
+			errDie(err)
+		}
+	} else if cmd == "import-bundle" {
+		if len(flag.Args()) != 2 {
+			helpDie("no bundle specified")
+		}
+		init()
+		if err := upd.ImportBundle(flag.Arg(1)); err != nil {
+			errDie(err)
+		}
+	} else if cmd == "diff" {
+		if len(flag.Args()) != 3 {
+			helpDie("diff needs two releases")
+		}
+		if *flagConfig != "" {
+			init()
+		}
+		var manifests [2]*updater.Manifest
+		for i := range manifests {
+			m, err := updater.LoadManifest(flag.Arg(i+1), upd.Config, http.DefaultClient)
+			if err != nil {
+				errDie(fmt.Errorf("%v: %v", flag.Arg(i+1), err))
+			}
+			manifests[i] = m
+		}
+		diff := updater.DiffManifests(manifests[0], manifests[1])
+		if *flagJson {
+			raw, err := json.MarshalIndent(diff, "", "\t")
+			if err != nil {
+				errDie(err)
+			}
+			os.Stdout.Write(raw)
+			os.Stdout.WriteString("\n")
+		} else {
+			diff.WriteText(os.Stdout)
+		}
+	} else if cmd == "verify" {
+		if len(flag.Args()) != 2 {
+			helpDie("no directory specified")
+		}
+		init()
+		drift, err := upd.Verify(flag.Arg(1))
+		if err != nil {
+			errDie(err)
+		}
+		drift.WriteText(os.Stdout)
+		if !drift.IsEmpty() && *flagRepair {
+			if err := upd.Repair(flag.Arg(1)); err != nil {
+				errDie(err)
+			}
+			if drift, err = upd.Verify(flag.Arg(1)); err != nil {
+				errDie(err)
+			}
+			fmt.Printf("After repair: ")
+			drift.WriteText(os.Stdout)
+		}
+		if !drift.IsEmpty() {
+			os.Exit(2)
+		}
+	} else if cmd == "publish-s3" {
+		if len(flag.Args()) != 3 {
+			helpDie("publish-s3 needs <dir> and <s3://bucket/path>")
+		}
+		init()
+		if err := updater.PublishS3(flag.Arg(1), upd.Config.S3, flag.Arg(2), http.DefaultClient); err != nil {
+			errDie(err)
 		}
 	} else if cmd == "run" {
 		init()
@@ -77,7 +203,55 @@ func main() {
 		upd.Download()
 	} else if cmd == "apply" {
 		init()
-		upd.Apply()
+		if *flagForce {
+			upd.ApplyNow()
+		} else {
+			upd.Apply()
+		}
+	} else if cmd == "plan" {
+		init()
+		plan, err := upd.Plan()
+		if err != nil {
+			errDie(err)
+		}
+		if *flagJson {
+			raw, err := json.MarshalIndent(plan, "", "\t")
+			if err != nil {
+				errDie(err)
+			}
+			os.Stdout.Write(raw)
+			os.Stdout.WriteString("\n")
+		} else {
+			plan.WriteText(os.Stdout)
+		}
+	} else if cmd == "status" {
+		init()
+		status := upd.Status()
+		if *flagJson {
+			raw, err := json.MarshalIndent(status, "", "\t")
+			if err != nil {
+				errDie(err)
+			}
+			os.Stdout.Write(raw)
+			os.Stdout.WriteString("\n")
+		} else {
+			status.WriteText(os.Stdout)
+		}
+		os.Exit(status.ExitCode())
+	} else if cmd == "archive" {
+		init()
+		for _, r := range upd.ArchivedReleases() {
+			fmt.Printf("%v %v %v\n", r.LocalPath, r.Hash, r.Time.Format("2006-01-02 15:04:05"))
+		}
+	} else if cmd == "rollback" {
+		init()
+		if err := upd.Rollback(*flagTo); err != nil {
+			errDie(err)
+		}
+		fmt.Printf("Rolled back. Automatic updates are paused until 'resume'.\n")
+	} else if cmd == "resume" {
+		init()
+		upd.Resume()
 	} else if cmd == "service" {
 		init()
 		if !upd.RunAsService() {
@@ -0,0 +1,285 @@
+package updater
+
+// This deals with the local archive of previous releases, and with rolling back to one of them.
+//
+// Before a release is replaced, a copy of it is kept in Config.ArchiveDir (unless that is empty), under
+// <ArchiveDir>/<LocalPath, flattened>/<manifest hash>. Only the newest Config.ArchiveKeep
+// releases of every SyncDir are kept. A rollback stages an archived release into LocalPathNext,
+// exactly as if it had been downloaded, and installs it through the normal apply path.
+// Automatic updates are then paused, otherwise the next cycle would simply undo the rollback.
+// Until they are resumed, we remember which releases were rolled back from, so that a second
+// rollback does not pick the release that the first one replaced (which archiving has just made
+// the newest in the archive).
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrNoArchivedRelease = errors.New("No archived release to roll back to")
+
+// A release in the archive
+type ArchivedRelease struct {
+	LocalPath string    // The SyncDir that the release belongs to
+	Hash      string    // manifest.hash of the release
+	Time      time.Time // When the release was last replaced
+}
+
+// Returns the archive of the given SyncDir (eg c:/imqsvar/archive/c__imqsbin)
+func (u *Updater) archiveRoot(syncDir *SyncDir) string {
+	flat := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.TrimRight(syncDir.LocalPath, "/\\"))
+	return path.Join(u.Config.ArchiveDir, flat)
+}
+
+// Returns true if archiveCurrent will copy the release in LocalPath into the archive
+func (u *Updater) willArchive(syncDir *SyncDir) bool {
+	if u.Config.ArchiveDir == "" || u.Config.ArchiveKeep <= 0 {
+		return false
+	}
+	hash := readHashFile(syncDir.LocalPath)
+	return hash != "" && readHashFile(path.Join(u.archiveRoot(syncDir), hash)) != hash
+}
+
+// Copy the release in LocalPath into the archive, and throw away old releases.
+// Every file is checked against the manifest while it is copied, so a tree that has
+// drifted since it was installed is not archived.
+func (u *Updater) archiveCurrent(syncDir *SyncDir) error {
+	if u.Config.ArchiveDir == "" || u.Config.ArchiveKeep <= 0 {
+		return nil
+	}
+	hash := readHashFile(syncDir.LocalPath)
+	if hash == "" {
+		return nil
+	}
+	root := u.archiveRoot(syncDir)
+	dst := path.Join(root, hash)
+	if readHashFile(dst) == hash {
+		// Already archived. Mark it as the most recent.
+		now := time.Now()
+		os.Chtimes(path.Join(dst, ManifestFilename_Hash), now, now)
+		return u.pruneArchive(syncDir)
+	}
+
+	manifest, err := ReadManifest(syncDir.LocalPath)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := u.copyRelease(&dirSource{root: syncDir.LocalPath}, manifest, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	u.log.Infof("Archived %v (%v) into %v", syncDir.LocalPath, hash, dst)
+	return u.pruneArchive(syncDir)
+}
+
+// Copy every file of 'manifest' from 'src' into dstDir, verifying each one.
+// The manifest itself is written last, with manifest.hash after manifest.content, so that a
+// half-written copy never has a manifest.hash.
+func (u *Updater) copyRelease(src Source, manifest *Manifest, dstDir string) error {
+	if err := u.ensureDirExists(dstDir); err != nil {
+		return err
+	}
+	for _, dir := range manifest.Dirs {
+		if err := u.ensureDirExists(path.Join(dstDir, dir)); err != nil {
+			return err
+		}
+	}
+	for i := range manifest.Files {
+		file := &manifest.Files[i]
+		outFile := path.Join(dstDir, file.Name)
+		if file.Link != "" {
+			if err := os.Symlink(filepath.FromSlash(file.Link), outFile); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := downloadFileVerified(src, file, outFile); err != nil {
+			return err
+		}
+		if err := setExecBit(outFile, file.Exec); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{ManifestFilename_Content, ManifestFilename_Hash} {
+		if err := downloadFile(src, name, path.Join(dstDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the archived releases of syncDir, newest first
+func (u *Updater) archivedReleases(syncDir *SyncDir) []ArchivedRelease {
+	if u.Config.ArchiveDir == "" {
+		return nil
+	}
+	root := u.archiveRoot(syncDir)
+	items, _ := ioutil.ReadDir(root)
+	res := []ArchivedRelease{}
+	for _, item := range items {
+		hashFile, err := os.Stat(path.Join(root, item.Name(), ManifestFilename_Hash))
+		if !item.IsDir() || err != nil || readHashFile(path.Join(root, item.Name())) != item.Name() {
+			continue
+		}
+		res = append(res, ArchivedRelease{LocalPath: syncDir.LocalPath, Hash: item.Name(), Time: hashFile.ModTime()})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Time.After(res[j].Time) })
+	return res
+}
+
+// Remove all but the newest ArchiveKeep releases of syncDir
+func (u *Updater) pruneArchive(syncDir *SyncDir) error {
+	releases := u.archivedReleases(syncDir)
+	for i := u.Config.ArchiveKeep; i < len(releases); i++ {
+		u.log.Infof("Removing archived release %v of %v", releases[i].Hash, syncDir.LocalPath)
+		if err := os.RemoveAll(path.Join(u.archiveRoot(syncDir), releases[i].Hash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the archived releases of every SyncDir, newest first
+func (u *Updater) ArchivedReleases() []ArchivedRelease {
+	res := []ArchivedRelease{}
+	for _, dir := range u.Config.allSyncDirs() {
+		res = append(res, u.archivedReleases(dir)...)
+	}
+	return res
+}
+
+// Install an archived release, and pause automatic updates.
+// If toHash is empty, then every SyncDir goes back to its most recently archived release. The release
+// that a previous rollback replaced is skipped, so that rolling back twice goes back two releases,
+// instead of returning to the release that we first rolled back from.
+// Otherwise, only the SyncDir that has an archived release starting with toHash is rolled back.
+func (u *Updater) Rollback(toHash string) error {
+	// Keep a running service away from LocalPath and LocalPathNext until we're done
+	for _, dir := range u.Config.allSyncDirs() {
+		if !u.claimDir(dir) {
+			u.log.Infof("Waiting for %v, which is busy", dir.LocalPath)
+			u.waitAndClaimDir(dir)
+		}
+		defer u.releaseDir(dir)
+	}
+
+	state := u.readState()
+	targets := map[*SyncDir]string{}
+	for _, dir := range u.Config.allSyncDirs() {
+		current := readHashFile(dir.LocalPath)
+		skip := map[string]bool{current: true}
+		if ds := state.Dirs[dir.LocalPath]; ds != nil && toHash == "" {
+			for _, hash := range ds.RolledBackFrom {
+				skip[hash] = true
+			}
+		}
+		for _, r := range u.archivedReleases(dir) {
+			if skip[r.Hash] {
+				continue
+			}
+			if toHash == "" {
+				targets[dir] = r.Hash
+				break
+			}
+			if strings.HasPrefix(r.Hash, toHash) {
+				if _, ok := targets[dir]; ok {
+					return fmt.Errorf("Hash prefix '%v' is ambiguous", toHash)
+				}
+				targets[dir] = r.Hash
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return ErrNoArchivedRelease
+	}
+	if toHash != "" && len(targets) != 1 {
+		return fmt.Errorf("Hash prefix '%v' is ambiguous", toHash)
+	}
+
+	// Pause first, so that a running service does not stage something else in the meantime
+	u.updateState(func(s *State) {
+		s.Paused = true
+		s.PausedReason = fmt.Sprintf("Rolling back, since %v", time.Now().Format("2006-01-02 15:04:05"))
+	})
+	replaced := map[*SyncDir]string{}
+	for dir := range targets {
+		replaced[dir] = readHashFile(dir.LocalPath)
+	}
+	err := u.rollbackTo(targets)
+	u.updateState(func(s *State) {
+		now := time.Now().Format("2006-01-02 15:04:05")
+		if err != nil {
+			s.PausedReason = fmt.Sprintf("Rollback failed at %v: %v", now, err)
+			return
+		}
+		s.PausedReason = fmt.Sprintf("Rolled back at %v", now)
+		for dir, hash := range replaced {
+			if hash != "" {
+				s.dir(dir).RolledBackFrom = append(s.dir(dir).RolledBackFrom, hash)
+			}
+		}
+	})
+	return err
+}
+
+// Stage the archived release 'targets[dir]' of every dir, and install them together
+func (u *Updater) rollbackTo(targets map[*SyncDir]string) error {
+	ready := []*SyncDir{}
+	for _, dir := range u.Config.allSyncDirs() {
+		hash, ok := targets[dir]
+		if !ok {
+			continue
+		}
+		u.log.Infof("Rolling back %v to %v", dir.LocalPath, hash)
+		src := &dirSource{root: path.Join(u.archiveRoot(dir), hash)}
+		if err := u.ensureDirExists(dir.LocalPathNext); err != nil {
+			return err
+		}
+		if err := downloadFile(src, ManifestFilename_Hash, path.Join(dir.LocalPathNext, ManifestFilename_Hash)); err != nil {
+			return err
+		}
+		if err := u.downloadContentFromSource(dir, src); err != nil {
+			return err
+		}
+		if isReady, err := dir.isReadyToApply(u.syncDirManifestBuilder(dir)); err != nil {
+			return err
+		} else if !isReady {
+			return fmt.Errorf("Archived release %v of %v is not consistent", hash, dir.LocalPath)
+		}
+		ready = append(ready, dir)
+	}
+	return u.applyDirs(ready)
+}
+
+// Resume automatic updates, after a rollback
+func (u *Updater) Resume() {
+	u.updateState(func(s *State) {
+		s.Paused = false
+		s.PausedReason = ""
+		for _, ds := range s.Dirs {
+			ds.RolledBackFrom = nil
+		}
+	})
+}
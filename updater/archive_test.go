@@ -0,0 +1,184 @@
+// +build !windows
+
+package updater
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollback(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	u.Config.ArchiveKeep = 2
+	dir := &u.Config.BinDir
+
+	// Install three releases in turn
+	hashes := []string{}
+	for i, content := range []string{"one", "two", "three"} {
+		release := path.Join(tmp, "release", content)
+		writeTestRelease(t, release, map[string]string{"a.txt": content, "b.txt": "same"})
+		dir.Remote.Path = release
+		u.Download()
+		u.Apply()
+		if readHashFile(dir.LocalPath) != readHashFile(release) {
+			t.Fatalf("Release %v was not installed", i)
+		}
+		hashes = append(hashes, readHashFile(release))
+	}
+	archived := u.ArchivedReleases()
+	if len(archived) != 2 || archived[0].Hash != hashes[1] || archived[1].Hash != hashes[0] {
+		t.Fatalf("Unexpected archive %+v", archived)
+	}
+
+	if err := u.Rollback(""); err != nil {
+		t.Fatal(err)
+	}
+	if readHashFile(dir.LocalPath) != hashes[1] {
+		t.Errorf("Expected rollback to the previous release")
+	}
+	if !u.readState().Paused {
+		t.Errorf("Expected automatic updates to be paused")
+	}
+	if drift, err := u.Verify(dir.LocalPath); err != nil || !drift.IsEmpty() {
+		t.Errorf("Rolled back release is not intact (%+v, %v)", drift, err)
+	}
+
+	// The release that we rolled back from is now archived too, so we can go forward again
+	if err := u.Rollback(hashes[2][:8]); err != nil {
+		t.Fatal(err)
+	}
+	if readHashFile(dir.LocalPath) != hashes[2] {
+		t.Errorf("Expected rollback to the chosen release")
+	}
+	if err := u.Rollback("nonexistent"); err != ErrNoArchivedRelease {
+		t.Errorf("Expected ErrNoArchivedRelease, but got %v", err)
+	}
+	u.Resume()
+	if u.readState().Paused {
+		t.Errorf("Expected automatic updates to be resumed")
+	}
+}
+
+func TestSecondRollbackGoesFurtherBack(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	u.Config.ArchiveKeep = 3
+	dir := &u.Config.BinDir
+
+	hashes := []string{}
+	for _, content := range []string{"one", "two", "three"} {
+		release := path.Join(tmp, "release", content)
+		writeTestRelease(t, release, map[string]string{"a.txt": content})
+		dir.Remote.Path = release
+		u.Download()
+		u.Apply()
+		hashes = append(hashes, readHashFile(release))
+	}
+	for _, expect := range []string{hashes[1], hashes[0]} {
+		if err := u.Rollback(""); err != nil {
+			t.Fatal(err)
+		}
+		if readHashFile(dir.LocalPath) != expect {
+			t.Fatalf("Expected each rollback to go back one more release")
+		}
+	}
+	if reason := u.readState().PausedReason; !strings.HasPrefix(reason, "Rolled back at") {
+		t.Errorf("Unexpected paused reason '%v'", reason)
+	}
+
+	// A rollback that fails must say so
+	os.Remove(path.Join(u.archiveRoot(dir), hashes[1], "a.txt"))
+	if err := u.Rollback(hashes[1][:8]); err == nil {
+		t.Fatalf("Expected rollback to a damaged release to fail")
+	}
+	if reason := u.readState().PausedReason; !strings.HasPrefix(reason, "Rollback failed at") {
+		t.Errorf("Expected the failure in the paused reason, but got '%v'", reason)
+	}
+}
+
+// A prefix that matches two archived releases of the same dir must not silently pick one of them
+func TestRollbackToAmbiguousPrefix(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	u.Config.ArchiveKeep = 20
+	dir := &u.Config.BinDir
+
+	// Install releases until two archived ones share their first hex digit
+	prefix := ""
+	for i := 0; prefix == "" && i < 18; i++ {
+		release := path.Join(tmp, "release", fmt.Sprint(i))
+		writeTestRelease(t, release, map[string]string{"a.txt": fmt.Sprint(i)})
+		dir.Remote.Path = release
+		u.Download()
+		u.Apply()
+		seen := map[string]bool{}
+		for _, r := range u.ArchivedReleases() {
+			if seen[r.Hash[:1]] {
+				prefix = r.Hash[:1]
+			}
+			seen[r.Hash[:1]] = true
+		}
+	}
+	current := readHashFile(dir.LocalPath)
+	if err := u.Rollback(prefix); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("Expected prefix '%v' to be ambiguous, but got %v", prefix, err)
+	}
+	if readHashFile(dir.LocalPath) != current {
+		t.Errorf("Expected no rollback with an ambiguous prefix")
+	}
+}
+
+// The service and updater-cmd are separate processes, so a rollback must wait for the service
+func TestRollbackWaitsForOtherProcess(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	dir := &u.Config.BinDir
+	for _, content := range []string{"one", "two"} {
+		release := path.Join(tmp, "release", content)
+		writeTestRelease(t, release, map[string]string{"a.txt": content})
+		dir.Remote.Path = release
+		u.Download()
+		u.Apply()
+	}
+	current := readHashFile(dir.LocalPath)
+
+	service := newTestUpdater(t, tmp)
+	if !service.claimDir(&service.Config.BinDir) {
+		t.Fatalf("Expected the service to claim the dir")
+	}
+	if u.claimDir(dir) {
+		t.Fatalf("Expected the dir to be busy for the other process")
+	}
+	done := make(chan error)
+	go func() {
+		done <- u.Rollback("")
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected the rollback to wait for the service")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if readHashFile(dir.LocalPath) != current {
+		t.Errorf("Expected nothing to be rolled back while the service is busy")
+	}
+	service.releaseDir(&service.Config.BinDir)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if readHashFile(dir.LocalPath) == current {
+		t.Errorf("Expected the rollback once the service was done")
+	}
+}
@@ -0,0 +1,346 @@
+package updater
+
+// This deals with offline bundles, which are used to update sites that have no internet.
+// A bundle is a .tar.gz file containing a complete release, including its manifest.
+// The first entry inside the bundle is always bundle.json, which tells the importer
+// which remote path the release belongs to.
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const bundleInfoFilename = "bundle.json"
+
+// Extensions of files inside Config.BundleDropDir that are treated as bundles, or as the result of an import
+const bundleExtension = ".tar.gz"
+const bundleExtensionImported = ".imported"
+const bundleExtensionFailed = ".failed"
+
+var ErrBundleNoInfo = errors.New("Bundle does not start with " + bundleInfoFilename)
+var ErrBundleInconsistent = errors.New("Bundle hash is inconsistent with its manifest")
+
+// The header of a bundle
+type bundleInfo struct {
+	RemotePath string // The remote path that this release was published to (eg imqsbin/stable). May be empty.
+	Hash       string // manifest.hash of the release
+}
+
+// Pack the release inside rootDir into bundleFile.
+// rootDir must contain a manifest that is consistent with the files on disk.
+// remotePath is recorded inside the bundle, so that the importer knows which SyncDir to stage it into.
+func ExportBundle(rootDir, bundleFile, remotePath string) error {
+	manifest, err := verifyReleaseDir(rootDir)
+	if err != nil {
+		return err
+	}
+
+	tmpFile := bundleFile + ".tmp"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	err = writeBundle(out, rootDir, manifest, remotePath)
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, bundleFile)
+}
+
+func writeBundle(out io.Writer, rootDir string, manifest *Manifest, remotePath string) error {
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	info, err := json.Marshal(&bundleInfo{
+		RemotePath: remotePath,
+		Hash:       hex.EncodeToString(manifest.hash()),
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: bundleInfoFilename, Mode: newFilePerms, Size: int64(len(info))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(info); err != nil {
+		return err
+	}
+
+	for _, dir := range manifest.Dirs {
+		if err := tw.WriteHeader(&tar.Header{Name: dir + "/", Mode: newDirPerms, Typeflag: tar.TypeDir}); err != nil {
+			return err
+		}
+	}
+	files := []ManifestFile{{Name: ManifestFilename_Content}, {Name: ManifestFilename_Hash}}
+	files = append(files, manifest.Files...)
+	for _, file := range files {
+		if file.Link != "" {
+			if err := tw.WriteHeader(&tar.Header{Name: file.Name, Linkname: file.Link, Mode: 0777, Typeflag: tar.TypeSymlink}); err != nil {
+				return err
+			}
+		} else if err := addFileToTar(tw, rootDir, file.Name, file.Exec); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addFileToTar(tw *tar.Writer, rootDir, name string, exec bool) error {
+	f, err := os.Open(path.Join(rootDir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    newFilePerms,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+	}
+	if exec {
+		hdr.Mode |= 0111
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Check the bundle, and stage its contents into the LocalPathNext of the SyncDir that it belongs to.
+// Once this is done, Apply will install the release as usual.
+func (u *Updater) ImportBundle(bundleFile string) error {
+	f, err := os.Open(bundleFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	info, err := readBundleInfo(tr)
+	if err != nil {
+		return err
+	}
+	syncDir, err := u.Config.syncDirForBundle(info)
+	if err != nil {
+		return err
+	}
+
+	// Extract next to LocalPathNext, so that the final rename does not cross volumes
+	extractDir := strings.TrimRight(syncDir.LocalPathNext, "/\\") + ".import"
+	if err := os.RemoveAll(extractDir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(extractDir)
+	if err := u.ensureDirExists(extractDir); err != nil {
+		return err
+	}
+	if err := extractTar(tr, extractDir); err != nil {
+		return err
+	}
+
+	manifest, err := verifyReleaseDir(extractDir)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(manifest.hash()) != info.Hash {
+		return ErrBundleInconsistent
+	}
+
+	// The dir may be busy downloading or being applied
+	u.waitAndClaimDir(syncDir)
+	defer u.releaseDir(syncDir)
+	u.log.Infof("Staging bundle %v (%v) into %v", bundleFile, info.Hash, syncDir.LocalPathNext)
+	if err := os.RemoveAll(syncDir.LocalPathNext); err != nil {
+		return err
+	}
+	return os.Rename(extractDir, syncDir.LocalPathNext)
+}
+
+// Import all bundles that have been dropped into Config.BundleDropDir.
+// Each bundle is renamed after the import, so that we only attempt it once.
+func (u *Updater) importDroppedBundles() {
+	if u.Config.BundleDropDir == "" {
+		return
+	}
+	items, err := ioutil.ReadDir(u.Config.BundleDropDir)
+	if err != nil {
+		u.warnf("Failed to read bundle drop dir %v: %v", u.Config.BundleDropDir, err)
+		return
+	}
+	for _, item := range items {
+		if item.IsDir() || !strings.HasSuffix(item.Name(), bundleExtension) {
+			continue
+		}
+		bundleFile := path.Join(u.Config.BundleDropDir, item.Name())
+		renameTo := bundleFile + bundleExtensionImported
+		if err := u.ImportBundle(bundleFile); err != nil {
+			u.errorf("Failed to import bundle %v: %v", bundleFile, err)
+			renameTo = bundleFile + bundleExtensionFailed
+		}
+		if err := os.Rename(bundleFile, renameTo); err != nil {
+			u.errorf("Failed to rename bundle %v: %v", bundleFile, err)
+		}
+	}
+}
+
+// Find the SyncDir that a bundle must be staged into
+func (c *Config) syncDirForBundle(info *bundleInfo) (*SyncDir, error) {
+	all := c.allSyncDirs()
+	if info.RemotePath == "" && len(all) == 1 {
+		return all[0], nil
+	}
+	for _, dir := range all {
+		if dir.Remote.Path == info.RemotePath {
+			return dir, nil
+		}
+	}
+	return nil, fmt.Errorf("No SyncDir is configured for remote path '%v'", info.RemotePath)
+}
+
+func readBundleInfo(tr *tar.Reader) (*bundleInfo, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != bundleInfoFilename {
+		return nil, ErrBundleNoInfo
+	}
+	raw, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, err
+	}
+	info := &bundleInfo{}
+	if err := json.Unmarshal(raw, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Extract the remainder of the tar stream into rootDir. Only plain files, directories, and symlinks
+// that stay inside rootDir are allowed.
+func extractTar(tr *tar.Reader, rootDir string) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || filepath.IsAbs(filepath.FromSlash(name)) {
+			return fmt.Errorf("Invalid path in bundle: %v", hdr.Name)
+		}
+		if err := checkNoLinkInPath(rootDir, name); err != nil {
+			return err
+		}
+		fullName := path.Join(rootDir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(fullName, newDirPerms|os.ModeDir); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(path.Dir(fullName), newDirPerms|os.ModeDir); err != nil {
+				return err
+			}
+			if err := writeFileFrom(fullName, tr); err != nil {
+				return err
+			}
+			os.Chtimes(fullName, hdr.ModTime, hdr.ModTime)
+			if err := setExecBit(fullName, hdr.Mode&0100 != 0); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !isLinkInside(name, hdr.Linkname) {
+				return fmt.Errorf("Invalid symlink in bundle: %v -> %v", hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(path.Dir(fullName), newDirPerms|os.ModeDir); err != nil {
+				return err
+			}
+			if err := os.Symlink(filepath.FromSlash(hdr.Linkname), fullName); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unsupported entry in bundle: %v", hdr.Name)
+		}
+	}
+}
+
+// Returns an error if name (relative to rootDir), or any of its parent dirs, is an existing symlink.
+// isLinkInside only checks the text of a link, so a chain of links (eg a -> . and then a/b -> ..)
+// could otherwise be used to write outside of rootDir.
+func checkNoLinkInPath(rootDir, name string) error {
+	dir := rootDir
+	for _, part := range strings.Split(name, "/") {
+		dir = path.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Invalid path in bundle: %v goes through a symlink", name)
+		}
+	}
+	return nil
+}
+
+func writeFileFrom(filename string, src io.Reader) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, newFilePerms)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// Returns the manifest of rootDir, if the manifest pair and the files on disk are all consistent
+func verifyReleaseDir(rootDir string) (*Manifest, error) {
+	manifest, err := ReadManifest(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := manifest.isConsistentWithHash(rootDir); err != nil {
+		return nil, err
+	}
+	truth, err := BuildManifest(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	truth.adoptReleaseInfo(manifest)
+	if !bytes.Equal(truth.hash(), manifest.hash()) || truth.extHash() != manifest.extHash() {
+		return nil, ErrContentInconsistent
+	}
+	return manifest, nil
+}
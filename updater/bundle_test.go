@@ -0,0 +1,135 @@
+package updater
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Create a new Updater that logs to a file inside 'tmp', and syncs tmp/current with tmp/next
+func newTestUpdater(t *testing.T, tmp string) *Updater {
+	u := NewUpdater()
+	u.Config.LogFile = path.Join(tmp, "updater.log")
+	u.Config.StateFile = path.Join(tmp, "state.json")
+	u.Config.ArchiveDir = path.Join(tmp, "archive")
+	u.Config.JournalFile = path.Join(tmp, "journal")
+	u.Config.BinDir.LocalPath = path.Join(tmp, "current")
+	u.Config.BinDir.LocalPathNext = path.Join(tmp, "next")
+	if err := u.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// Write 'files' (name -> content) into rootDir, and build its manifest
+func writeTestRelease(t *testing.T, rootDir string, files map[string]string) {
+	for name, content := range files {
+		fullName := path.Join(rootDir, name)
+		if err := os.MkdirAll(path.Dir(fullName), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fullName, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := BuildManifest(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write(rootDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{
+		"a.txt":     "hello",
+		"bin/b.exe": "binary",
+	})
+
+	bundle := path.Join(tmp, "release.tar.gz")
+	if err := ExportBundle(release, bundle, u.Config.BinDir.Remote.Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ImportBundle(bundle); err != nil {
+		t.Fatal(err)
+	}
+	if readHashFile(u.Config.BinDir.LocalPathNext) != readHashFile(release) {
+		t.Errorf("Staged hash differs from release")
+	}
+	if ready, err := u.Config.BinDir.isReadyToApply(u.buildManifest); err != nil || !ready {
+		t.Errorf("Expected imported bundle to be ready to apply (%v, %v)", ready, err)
+	}
+}
+
+func TestBundleRejectsTamperedRelease(t *testing.T) {
+	tmp := t.TempDir()
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{"a.txt": "hello"})
+	ioutil.WriteFile(path.Join(release, "a.txt"), []byte("tampered"), 0666)
+	if err := ExportBundle(release, path.Join(tmp, "release.tar.gz"), ""); err != ErrContentInconsistent {
+		t.Errorf("Expected ErrContentInconsistent, but got %v", err)
+	}
+}
+
+func TestBundleImportWaitsForBusyDir(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{"a.txt": "hello"})
+	bundle := path.Join(tmp, "release.tar.gz")
+	if err := ExportBundle(release, bundle, u.Config.BinDir.Remote.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend that a download is busy with the dir
+	u.waitAndClaimDir(&u.Config.BinDir)
+	done := make(chan error)
+	go func() {
+		done <- u.ImportBundle(bundle)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected the import to wait for the busy dir")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if readHashFile(u.Config.BinDir.LocalPathNext) == readHashFile(release) {
+		t.Errorf("Expected nothing to be staged while the dir is busy")
+	}
+	u.releaseDir(&u.Config.BinDir)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if readHashFile(u.Config.BinDir.LocalPathNext) != readHashFile(release) {
+		t.Errorf("Expected the bundle to be staged once the dir was free")
+	}
+}
+
+func TestBundleCannotWriteThroughSymlinks(t *testing.T) {
+	tmp := t.TempDir()
+	extractDir := path.Join(tmp, "extract")
+	if err := os.Mkdir(extractDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."})
+	tw.WriteHeader(&tar.Header{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."})
+	tw.WriteHeader(&tar.Header{Name: "b/evil.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("evil"))
+	tw.Close()
+
+	if err := extractTar(tar.NewReader(buf), extractDir); err == nil {
+		t.Error("Expected the bundle to be rejected")
+	}
+	if _, err := os.Stat(path.Join(tmp, "evil.txt")); !os.IsNotExist(err) {
+		t.Error("A bundle may not write outside of the extract dir")
+	}
+}
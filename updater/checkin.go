@@ -0,0 +1,103 @@
+package updater
+
+// This deals with check-ins, which are small status reports that the updater sends
+// to the deploy server after every cycle, so that the server knows which release
+// every site is running.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Version of the updater, reported in check-ins.
+// Override this at build time with -ldflags "-X github.com/IMQS/updater/updater.Version=1.2.3"
+var Version = "dev"
+
+// A report of the state of one machine
+type Checkin struct {
+	MachineID string       // Config.MachineID, or the hostname if that is empty
+	Hostname  string       // As reported by the OS
+	Version   string       // Updater version
+	Time      time.Time    // Client time when the check-in was sent
+	LastError string       // Most recent error during the last cycle, or empty if the cycle succeeded
+	Dirs      []CheckinDir // One entry per SyncDir
+}
+
+// The state of a single SyncDir, as reported in a check-in
+type CheckinDir struct {
+	RemotePath  string // eg imqsbin/stable
+	LocalPath   string // eg c:/imqsbin
+	CurrentHash string // manifest.hash inside LocalPath
+	StagedHash  string // manifest.hash inside LocalPathNext
+
+	InsufficientSpace *InsufficientSpaceError `json:",omitempty"` // Set if the last disk space check failed
+}
+
+// Build a check-in from the current state of all SyncDirs
+func (u *Updater) buildCheckin() *Checkin {
+	c := &Checkin{
+		Version:   Version,
+		Time:      time.Now().UTC(),
+		LastError: u.getLastError(),
+	}
+	c.Hostname, _ = os.Hostname()
+	c.MachineID = u.Config.MachineID
+	if c.MachineID == "" {
+		c.MachineID = c.Hostname
+	}
+	state := u.readState()
+	for _, dir := range u.Config.allSyncDirs() {
+		c.Dirs = append(c.Dirs, CheckinDir{
+			RemotePath:        dir.Remote.Path,
+			LocalPath:         dir.LocalPath,
+			CurrentHash:       readHashFile(dir.LocalPath),
+			StagedHash:        readHashFile(dir.LocalPathNext),
+			InsufficientSpace: state.dir(dir).InsufficientSpace,
+		})
+	}
+	return c
+}
+
+// Send a check-in to Config.CheckinUrl. Does nothing if CheckinUrl is empty.
+func (u *Updater) sendCheckin() error {
+	if u.Config.CheckinUrl == "" {
+		return nil
+	}
+	body, err := json.Marshal(u.buildCheckin())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u.Config.CheckinUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u.Config.CheckinToken != "" {
+		req.Header.Set("Authorization", "Bearer "+u.Config.CheckinToken)
+	}
+	res, err := u.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("Error posting check-in to " + u.Config.CheckinUrl + ": " + res.Status)
+	}
+	return nil
+}
+
+// Returns the contents of manifest.hash inside rootDir, or an empty string if it cannot be read
+func readHashFile(rootDir string) string {
+	raw, err := ioutil.ReadFile(path.Join(rootDir, ManifestFilename_Hash))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(raw))
+}
@@ -0,0 +1,57 @@
+package updater
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestSendCheckin(t *testing.T) {
+	var received *Checkin
+	auth := ""
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		received = &Checkin{}
+		if err := json.NewDecoder(r.Body).Decode(received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.Config.MachineID = "site-1"
+	u.Config.BinDir.Remote.Path = "imqsbin/stable"
+	writeTestRelease(t, u.Config.BinDir.LocalPath, map[string]string{"a.txt": "one"})
+	writeTestRelease(t, u.Config.BinDir.LocalPathNext, map[string]string{"a.txt": "two"})
+
+	// Nothing is sent without a CheckinUrl
+	if err := u.sendCheckin(); err != nil || received != nil {
+		t.Fatalf("Expected no check-in (%v, %+v)", err, received)
+	}
+
+	u.Config.CheckinUrl = server.URL
+	u.Config.CheckinToken = "sesame"
+	if err := u.sendCheckin(); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer sesame" {
+		t.Errorf("Expected the token to be sent, but got '%v'", auth)
+	}
+	if received.MachineID != "site-1" || received.Version != Version || len(received.Dirs) != 1 {
+		t.Fatalf("Unexpected check-in %+v", received)
+	}
+	d := received.Dirs[0]
+	if d.RemotePath != "imqsbin/stable" || d.LocalPath != u.Config.BinDir.LocalPath || d.CurrentHash != readHashFile(u.Config.BinDir.LocalPath) || d.StagedHash != readHashFile(path.Join(tmp, "next")) {
+		t.Errorf("Unexpected dir %+v", d)
+	}
+
+	status = http.StatusUnauthorized
+	if err := u.sendCheckin(); err == nil {
+		t.Error("Expected a refused check-in to be an error")
+	}
+}
@@ -0,0 +1,296 @@
+package updater
+
+// This deals with content-defined chunking of large files.
+//
+// Large files (database seed dumps, map tiles) often change only a little between releases.
+// The publisher can split such files into chunks, whose boundaries are determined by the
+// content itself (a rolling "gear" hash), so that an insertion near the start of a file
+// only changes the chunks around the insertion. The chunks are listed in the manifest,
+// but they are not part of manifest.hash, because the file as a whole is still verified
+// against its own hash.
+//
+// When a chunked file changes, the client chunks its old copies of the file, copies over
+// all the chunks that it already has, and fetches only the missing chunks, using ranged
+// reads of the file on the server. No extra files need to be published.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// Chunk size limits. The average chunk size is determined by chunkMask (20 bits = 1 MB).
+const chunkMin = 256 * 1024
+const chunkMax = 4 * 1024 * 1024
+const chunkMask = (1 << 20) - 1
+
+var ErrRangeNotSupported = errors.New("Source does not support ranged reads")
+var ErrChunksInvalid = errors.New("Chunk sizes must be between 1 byte and 4 MB, and add up to the size of the file")
+
+// A piece of a large file
+type ManifestChunk struct {
+	Hash string // hex-encoded SHA256 hash of the chunk contents
+	Size int64
+}
+
+// A Source that can read part of a file
+type rangeSource interface {
+	OpenRange(name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// The gear table must be identical on the publisher and on every client, so it is generated from a fixed seed
+var chunkGear [256]uint64
+
+func init() {
+	// splitmix64
+	seed := uint64(0x1D2B3C4D5E6F7081)
+	for i := range chunkGear {
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		chunkGear[i] = z ^ (z >> 31)
+	}
+}
+
+// Split the stream into content-defined chunks, and call 'chunk' for each of them.
+// The data passed to 'chunk' is only valid for the duration of the call.
+func splitChunks(r io.Reader, chunk func(data []byte) error) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	buf := make([]byte, 0, chunkMax)
+	h := uint64(0)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+		h = (h << 1) + chunkGear[b]
+		if (len(buf) >= chunkMin && h&chunkMask == 0) || len(buf) >= chunkMax {
+			if err := chunk(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+			h = 0
+		}
+	}
+	if len(buf) != 0 {
+		return chunk(buf)
+	}
+	return nil
+}
+
+// Returns the chunks of a file on disk
+func chunkFile(filename string) ([]ManifestChunk, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunks := []ManifestChunk{}
+	err = splitChunks(f, func(data []byte) error {
+		hash := sha256.Sum256(data)
+		chunks = append(chunks, ManifestChunk{Hash: hex.EncodeToString(hash[:]), Size: int64(len(data))})
+		return nil
+	})
+	return chunks, err
+}
+
+// Split every file in 'm' that is at least minSize bytes into chunks.
+// This must be done before the manifest is written.
+func AddChunks(rootDir string, m *Manifest, minSize int64) error {
+	for i := range m.Files {
+		f := &m.Files[i]
+		f.Chunks = nil
+		if f.Link != "" {
+			continue
+		}
+		size, err := getFileSize(path.Join(rootDir, f.Name))
+		if err != nil {
+			return err
+		}
+		if size < minSize {
+			continue
+		}
+		if f.Chunks, err = chunkFile(path.Join(rootDir, f.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chunks are not part of manifest.hash, so their sizes must be sane before we trust them.
+// Manifests from before file sizes were recorded can only have the size of each chunk checked.
+func (m *Manifest) validateChunks() error {
+	for _, f := range m.Files {
+		total := int64(0)
+		for _, c := range f.Chunks {
+			if c.Size <= 0 || c.Size > chunkMax {
+				return fmt.Errorf("Invalid chunks in manifest '%v': %w", f.Name, ErrChunksInvalid)
+			}
+			total += c.Size
+		}
+		if len(f.Chunks) != 0 && f.Size != 0 && total != f.Size {
+			return fmt.Errorf("Invalid chunks in manifest '%v': %w", f.Name, ErrChunksInvalid)
+		}
+	}
+	return nil
+}
+
+// The location of a chunk that we already have on disk
+type localChunk struct {
+	filename string
+	offset   int64
+}
+
+// Index the chunks of all of the given files that exist
+func indexLocalChunks(filenames []string) map[string]localChunk {
+	index := map[string]localChunk{}
+	for _, filename := range filenames {
+		chunks, err := chunkFile(filename)
+		if err != nil {
+			continue
+		}
+		offset := int64(0)
+		for _, c := range chunks {
+			if _, exists := index[c.Hash]; !exists {
+				index[c.Hash] = localChunk{filename, offset}
+			}
+			offset += c.Size
+		}
+	}
+	return index
+}
+
+// Build 'file' inside outFile, by copying the chunks that we have in our old copies of the file
+// (in LocalPath and LocalPathNext), and fetching the rest from 'src'.
+// Returns the number of bytes fetched from src.
+func (u *Updater) downloadChunked(syncDir *SyncDir, src Source, file *ManifestFile, outFile string) (int64, error) {
+	rs, ok := src.(rangeSource)
+	if !ok {
+		return 0, ErrRangeNotSupported
+	}
+	have := indexLocalChunks([]string{
+		path.Join(syncDir.LocalPath, file.Name),
+		path.Join(syncDir.LocalPathNext, file.Name),
+	})
+
+	// Write to a temporary file, because the old copy in LocalPathNext is one of our inputs
+	tmpFile := outFile + ".chunks"
+	out, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, newFilePerms)
+	if err != nil {
+		return 0, err
+	}
+	fetched, err := u.assembleChunks(out, rs, have, file)
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		var actual string
+		if actual, err = hashFile(tmpFile); err == nil && actual != file.Hash {
+			err = fmt.Errorf("%v: %w", file.Name, ErrFileHashMismatch)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, outFile)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return 0, err
+	}
+	u.log.Debugf("Assembled %v from %v chunks. Fetched %v of %v bytes", file.Name, len(file.Chunks), fetched, file.totalChunkSize())
+	return fetched, nil
+}
+
+func (u *Updater) assembleChunks(out io.Writer, src rangeSource, have map[string]localChunk, file *ManifestFile) (int64, error) {
+	fetched := int64(0)
+	offset := int64(0)
+	for i := 0; i < len(file.Chunks); {
+		c := file.Chunks[i]
+		if local, ok := have[c.Hash]; ok {
+			if err := copyChunk(out, local, &c); err != nil {
+				return 0, err
+			}
+			offset += c.Size
+			i++
+			continue
+		}
+		// Fetch the whole run of consecutive missing chunks with a single request
+		run := []ManifestChunk{}
+		runSize := int64(0)
+		for ; i < len(file.Chunks); i++ {
+			if _, ok := have[file.Chunks[i].Hash]; ok {
+				break
+			}
+			run = append(run, file.Chunks[i])
+			runSize += file.Chunks[i].Size
+		}
+		if err := fetchChunks(out, src, file.Name, offset, run); err != nil {
+			return 0, err
+		}
+		offset += runSize
+		fetched += runSize
+	}
+	return fetched, nil
+}
+
+func copyChunk(out io.Writer, local localChunk, c *ManifestChunk) error {
+	f, err := os.Open(local.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(local.offset, io.SeekStart); err != nil {
+		return err
+	}
+	return copyVerifiedChunk(out, f, c)
+}
+
+func fetchChunks(out io.Writer, src rangeSource, name string, offset int64, run []ManifestChunk) error {
+	length := int64(0)
+	for _, c := range run {
+		length += c.Size
+	}
+	r, err := src.OpenRange(name, offset, length)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for i := range run {
+		if err := copyVerifiedChunk(out, r, &run[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy exactly c.Size bytes from r to out, and check that they hash to c.Hash.
+// A bad chunk is already in 'out' by the time we notice, so the caller must discard 'out' on error, as downloadChunked does.
+func copyVerifiedChunk(out io.Writer, r io.Reader, c *ManifestChunk) error {
+	h := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(out, h), r, c.Size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != c.Hash {
+		return ErrFileHashMismatch
+	}
+	return nil
+}
+
+func (f *ManifestFile) totalChunkSize() int64 {
+	total := int64(0)
+	for _, c := range f.Chunks {
+		total += c.Size
+	}
+	return total
+}
@@ -0,0 +1,61 @@
+package updater
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"testing"
+)
+
+func TestChunkedDownload(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+
+	// Version 1 is installed
+	v1 := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(1)).Read(v1)
+	writeTestRelease(t, u.Config.BinDir.LocalPath, map[string]string{"seed.dump": string(v1)})
+
+	// Version 2 has a few bytes inserted in the middle
+	v2 := append(append(append([]byte{}, v1[:3000000]...), []byte("new data")...), v1[3000000:]...)
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{"seed.dump": string(v2)})
+	m, _ := ReadManifest(release)
+	if err := AddChunks(release, m, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files[0].Chunks) < 2 {
+		t.Fatalf("Expected seed.dump to be split into chunks")
+	}
+
+	outFile := path.Join(u.Config.BinDir.LocalPathNext, "seed.dump")
+	u.ensureDirExists(u.Config.BinDir.LocalPathNext)
+	fetched, err := u.downloadChunked(&u.Config.BinDir, &dirSource{root: release}, &m.Files[0], outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched == 0 || fetched > int64(len(v2))/2 {
+		t.Errorf("Expected only the changed chunks to be fetched, but fetched %v of %v bytes", fetched, len(v2))
+	}
+	if body, _ := ioutil.ReadFile(outFile); string(body) != string(v2) {
+		t.Errorf("Assembled file is incorrect")
+	}
+}
+
+func TestInvalidChunksAreRejected(t *testing.T) {
+	cases := []string{
+		`{"Files":[{"Name":"a","Hash":"x","Size":10,"Chunks":[{"Hash":"y","Size":0},{"Hash":"z","Size":10}]}]}`,
+		`{"Files":[{"Name":"a","Hash":"x","Chunks":[{"Hash":"y","Size":1000000000000}]}]}`,
+		`{"Files":[{"Name":"a","Hash":"x","Size":10,"Chunks":[{"Hash":"y","Size":4},{"Hash":"z","Size":4}]}]}`,
+	}
+	for _, c := range cases {
+		if _, err := parseManifest([]byte(c)); !errors.Is(err, ErrChunksInvalid) {
+			t.Errorf("Expected ErrChunksInvalid for %v, but got %v", c, err)
+		}
+	}
+	good := `{"Files":[{"Name":"a","Hash":"x","Size":10,"Chunks":[{"Hash":"y","Size":6},{"Hash":"z","Size":4}]}]}`
+	if _, err := parseManifest([]byte(good)); err != nil {
+		t.Errorf("Expected valid chunks to be accepted, but got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package updater
+
+// This deals with pre-compressed copies of release files.
+//
+// The publisher can write a compressed sibling next to every file that compresses well
+// (eg bin/imqs.exe.gz or bin/imqs.exe.zst next to bin/imqs.exe), and lists those files in
+// manifest.compressed. A release uses a single encoding for all of its siblings. Clients ask for
+// the compressed variant, and decompress it before doing anything else, so hashes are always
+// defined over the uncompressed bytes. If the decompressed file does not match its hash (eg because
+// manifest.compressed is stale), then the client reads the file itself instead.
+//
+// Over HTTP, the client sends "Accept-Encoding: zstd, gzip", and the server replies with
+// "Content-Encoding: zstd" or "Content-Encoding: gzip" if it has a compressed sibling in that
+// encoding. This is what nginx does with "gzip_static on" (for gzip only), and what server-cmd does.
+// Directory and S3 sources look for the sibling themselves.
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const ManifestFilename_Compressed = "manifest.compressed"
+
+// A compressed sibling must be at most this fraction of the size of the original, otherwise it is not worth it
+const compressMaxRatio = 0.9
+
+// A way of compressing files
+type contentEncoding struct {
+	name      string // As used in Content-Encoding
+	extension string // Extension of the compressed sibling
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	newWriter func(w io.Writer) io.WriteCloser
+}
+
+var gzipEncoding = &contentEncoding{
+	name:      "gzip",
+	extension: ".gz",
+	newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	newWriter: func(w io.Writer) io.WriteCloser {
+		gz, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+		return gz
+	},
+}
+
+var zstdEncoding = &contentEncoding{
+	name:      "zstd",
+	extension: ".zst",
+	newReader: func(r io.Reader) (io.ReadCloser, error) {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	},
+	newWriter: func(w io.Writer) io.WriteCloser {
+		enc, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		return enc
+	},
+}
+
+// All of the encodings that we understand, in order of preference
+var contentEncodings = []*contentEncoding{zstdEncoding, gzipEncoding}
+
+// Returns the names of the encodings that we understand (eg "gzip"), in order of preference
+func ContentEncodings() []string {
+	names := []string{}
+	for _, e := range contentEncodings {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+// Returns the extension of compressed siblings in 'encoding' (eg ".gz" for "gzip"), or empty if we don't know the encoding
+func CompressedExtension(encoding string) string {
+	if e := findContentEncoding(encoding); e != nil {
+		return e.extension
+	}
+	return ""
+}
+
+// Returns the encoding with the given Content-Encoding name, or nil
+func findContentEncoding(name string) *contentEncoding {
+	for _, e := range contentEncodings {
+		if e.name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// The value of our Accept-Encoding header
+func acceptEncodingHeader() string {
+	return strings.Join(ContentEncodings(), ", ")
+}
+
+// Wraps a decompressing reader, so that closing it also closes the underlying stream
+type decodingReader struct {
+	io.ReadCloser
+	underlying io.Closer
+}
+
+func (r *decodingReader) Close() error {
+	r.ReadCloser.Close()
+	return r.underlying.Close()
+}
+
+// Wrap 'r' in a decompressor. If that fails, then 'r' is closed.
+func decodeStream(e *contentEncoding, r io.ReadCloser) (io.ReadCloser, error) {
+	dec, err := e.newReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &decodingReader{ReadCloser: dec, underlying: r}, nil
+}
+
+// manifest.compressed maps the name of every file that has a compressed sibling to the size of the sibling.
+// Publishers before the sizes were recorded wrote a plain list of names, in which case the sizes are -1.
+func ParseCompressedList(raw []byte) map[string]int64 {
+	res := map[string]int64{}
+	if json.Unmarshal(raw, &res) == nil {
+		return res
+	}
+	names := []string{}
+	json.Unmarshal(raw, &names)
+	for _, name := range names {
+		res[name] = -1
+	}
+	return res
+}
+
+// Returns the set of files inside rootDir that have compressed siblings
+func readCompressedList(rootDir string) map[string]bool {
+	res := map[string]bool{}
+	raw, err := ioutil.ReadFile(path.Join(rootDir, ManifestFilename_Compressed))
+	if err != nil {
+		return res
+	}
+	for name := range ParseCompressedList(raw) {
+		res[name] = true
+	}
+	return res
+}
+
+// Returns the names of the compressed siblings inside rootDir, which must not be treated as part of the release.
+// manifest.compressed can be stale (eg when a real foo.gz has since replaced our sibling of foo), so a file is only
+// treated as a sibling if it still has the size that we recorded when we wrote it.
+func compressedSiblings(rootDir string) map[string]bool {
+	res := map[string]bool{}
+	raw, err := ioutil.ReadFile(path.Join(rootDir, ManifestFilename_Compressed))
+	if err != nil {
+		return res
+	}
+	for name, size := range ParseCompressedList(raw) {
+		for _, e := range contentEncodings {
+			sibling := name + e.extension
+			if actual, err := getFileSize(path.Join(rootDir, sibling)); err == nil && (size < 0 || actual == size) {
+				res[sibling] = true
+			}
+		}
+	}
+	return res
+}
+
+// Write a compressed sibling in 'encoding' (eg "gzip") of every file in 'm' (and of manifest.content) that
+// compresses well, and list them in manifest.compressed. Siblings from a previous run that are no longer needed
+// are removed. This must be run after the manifest has been written.
+func WriteCompressedSiblings(rootDir string, m *Manifest, encoding string) error {
+	e := findContentEncoding(encoding)
+	if e == nil {
+		return fmt.Errorf("Unknown compression '%v'", encoding)
+	}
+	previous := compressedSiblings(rootDir)
+	names := []string{ManifestFilename_Content}
+	realFiles := m.nameToFileMap()
+	for _, f := range m.Files {
+		if f.Link == "" {
+			names = append(names, f.Name)
+		}
+	}
+
+	compressed := map[string]int64{}
+	keep := map[string]bool{}
+	for _, name := range names {
+		// Never overwrite a real file that happens to have the name of a sibling
+		if realFiles[name+e.extension] != nil {
+			continue
+		}
+		size, err := writeCompressedSibling(path.Join(rootDir, name), e)
+		if err != nil {
+			return err
+		}
+		if size >= 0 {
+			compressed[name] = size
+			keep[name+e.extension] = true
+		}
+	}
+	for sibling := range previous {
+		if !keep[sibling] && realFiles[sibling] == nil {
+			os.Remove(path.Join(rootDir, sibling))
+		}
+	}
+
+	raw, err := json.MarshalIndent(compressed, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(rootDir, ManifestFilename_Compressed), raw, 0666)
+}
+
+// Returns the size of the sibling that was written, or -1 if the file does not compress well enough.
+// The file is compressed as a stream, because release files can be much larger than memory.
+func writeCompressedSibling(filename string, e *contentEncoding) (int64, error) {
+	in, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	sibling := filename + e.extension
+	tmpFile := sibling + ".tmp"
+	out, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return 0, err
+	}
+	w := e.newWriter(out)
+	size, err := io.Copy(w, in)
+	if errClose := w.Close(); err == nil {
+		err = errClose
+	}
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	compressedSize := int64(0)
+	if err == nil {
+		compressedSize, err = getFileSize(tmpFile)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return 0, err
+	}
+	if float64(compressedSize) > float64(size)*compressMaxRatio {
+		os.Remove(tmpFile)
+		os.Remove(sibling)
+		return -1, nil
+	}
+	return compressedSize, os.Rename(tmpFile, sibling)
+}
+
+// Remove all compressed siblings, and manifest.compressed. This is used when a release is
+// republished without compression, so that we never leave stale siblings behind.
+func RemoveCompressedSiblings(rootDir string) error {
+	for sibling := range compressedSiblings(rootDir) {
+		if err := os.Remove(path.Join(rootDir, sibling)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(path.Join(rootDir, ManifestFilename_Compressed)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package updater
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCompressedSiblings(t *testing.T) {
+	for _, encoding := range ContentEncodings() {
+		tmp := t.TempDir()
+		release := path.Join(tmp, "release")
+		writeTestRelease(t, release, map[string]string{
+			"big.txt":   strings.Repeat("compress me ", 1000),
+			"small.txt": "x",
+		})
+		ext := CompressedExtension(encoding)
+		before, _ := ReadManifest(release)
+		if err := WriteCompressedSiblings(release, before, encoding); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path.Join(release, "big.txt"+ext)); err != nil {
+			t.Errorf("Expected big.txt%v to be written", ext)
+		}
+		if _, err := os.Stat(path.Join(release, "small.txt"+ext)); err == nil {
+			t.Errorf("small.txt%v should not be written, because it doesn't compress", ext)
+		}
+		after, err := BuildManifest(release)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before.hash(), after.hash()) {
+			t.Errorf("Compressed siblings must not change the manifest")
+		}
+
+		// Remove the originals, so that only the compressed siblings can satisfy the download
+		os.Remove(path.Join(release, "big.txt"))
+		u := newTestUpdater(t, tmp)
+		u.Config.BinDir.Remote.Path = release
+		u.Download()
+		if ready, err := u.Config.BinDir.isReadyToApply(u.buildManifest); err != nil || !ready {
+			t.Errorf("Expected download of %v siblings to be ready to apply (%v, %v)", encoding, ready, err)
+		}
+	}
+	if err := WriteCompressedSiblings(t.TempDir(), &Manifest{}, "brotli"); err == nil {
+		t.Errorf("Expected an unknown compression to be refused")
+	}
+}
+
+// A release that is rebuilt without rewriting its siblings still lists them in manifest.compressed,
+// but they no longer match the manifest, so we must fall back to the files themselves
+func TestStaleCompressedSiblingFallsBackToFile(t *testing.T) {
+	tmp := t.TempDir()
+	release := path.Join(tmp, "release")
+	// Enough files for manifest.content to be worth compressing
+	files := map[string]string{"big.txt": strings.Repeat("compress me ", 1000)}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("small-%v.txt", i)] = fmt.Sprint(i)
+	}
+	writeTestRelease(t, release, files)
+	m, _ := ReadManifest(release)
+	if err := WriteCompressedSiblings(release, m, "zstd"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestRelease(t, release, map[string]string{"big.txt": strings.Repeat("compress me too ", 1000)})
+	if sizes := readCompressedList(release); !sizes["big.txt"] || !sizes[ManifestFilename_Content] {
+		t.Fatalf("Expected manifest.compressed to still list the stale siblings")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Join(release, r.URL.Path)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "zstd") {
+			if _, err := os.Stat(name + ".zst"); err == nil {
+				w.Header().Set("Content-Encoding", "zstd")
+				http.ServeFile(w, r, name+".zst")
+				return
+			}
+		}
+		http.ServeFile(w, r, name)
+	}))
+	defer server.Close()
+
+	for _, remote := range []string{release, server.URL} {
+		u := newTestUpdater(t, t.TempDir())
+		u.Config.BinDir.Remote.Path = remote
+		u.Download()
+		if ready, err := u.Config.BinDir.isReadyToApply(u.buildManifest); err != nil || !ready {
+			t.Errorf("Expected %v to fall back to the uncompressed files (%v, %v)", remote, ready, err)
+		}
+	}
+}
+
+func TestStaleCompressedListDoesNotHideRealFiles(t *testing.T) {
+	tmp := t.TempDir()
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{"big.txt": strings.Repeat("compress me ", 1000)})
+	m, _ := ReadManifest(release)
+	if err := WriteCompressedSiblings(release, m, "gzip"); err != nil {
+		t.Fatal(err)
+	}
+	// A real big.txt.gz replaces our sibling, but manifest.compressed still lists big.txt
+	if err := ioutil.WriteFile(path.Join(release, "big.txt.gz"), []byte("not our sibling"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	after, err := BuildManifest(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.nameToFileMap()["big.txt.gz"] == nil {
+		t.Errorf("Expected the real big.txt.gz to be part of the manifest")
+	}
+}
+
+func TestHttpContentEncoding(t *testing.T) {
+	tmp := t.TempDir()
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{"big.txt": strings.Repeat("compress me ", 1000)})
+	m, _ := ReadManifest(release)
+	if err := WriteCompressedSiblings(release, m, "gzip"); err != nil {
+		t.Fatal(err)
+	}
+	gzipServed := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Join(release, r.URL.Path)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			if _, err := os.Stat(name + ".gz"); err == nil {
+				gzipServed[r.URL.Path] = true
+				w.Header().Set("Content-Encoding", "gzip")
+				http.ServeFile(w, r, name+".gz")
+				return
+			}
+		}
+		http.ServeFile(w, r, name)
+	}))
+	defer server.Close()
+
+	u := newTestUpdater(t, tmp)
+	u.Config.BinDir.Remote.Path = server.URL
+	u.Download()
+	if ready, err := u.Config.BinDir.isReadyToApply(u.buildManifest); err != nil || !ready {
+		t.Errorf("Expected gzip download to be ready to apply (%v, %v)", ready, err)
+	}
+	if !gzipServed["/big.txt"] {
+		t.Errorf("Expected big.txt to be served compressed")
+	}
+}
@@ -0,0 +1,75 @@
+package updater
+
+// This makes the common "has anything changed?" check nearly free for the server.
+//
+// manifest.hash is fetched with If-None-Match and If-Modified-Since, using the ETag and
+// Last-Modified of the previous response from the same URL. When the server answers
+// 304 Not Modified, we use the body that we remembered. The validators are only kept in
+// memory, so the first check after a restart is a plain GET.
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// The validators and body of a previous response
+type conditionalEntry struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+type conditionalCache struct {
+	lock    sync.Mutex
+	entries map[string]*conditionalEntry // Key is the URL
+}
+
+func newConditionalCache() *conditionalCache {
+	return &conditionalCache{
+		entries: map[string]*conditionalEntry{},
+	}
+}
+
+// Returns nil if we have nothing for 'url'
+func (c *conditionalCache) get(url string) *conditionalEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries[url]
+}
+
+// Read all of 'body', remember it if 'res' has validators, and return a reader over it
+func (c *conditionalCache) remember(url string, res *http.Response, body io.ReadCloser) (io.ReadCloser, error) {
+	raw, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	e := &conditionalEntry{
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+		body:         raw,
+	}
+	c.lock.Lock()
+	if e.etag != "" || e.lastModified != "" {
+		c.entries[url] = e
+	} else {
+		delete(c.entries, url)
+	}
+	c.lock.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(raw)), nil
+}
+
+func (e *conditionalEntry) addHeaders(req *http.Request) {
+	if e == nil {
+		return
+	}
+	if e.etag != "" {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	if e.lastModified != "" {
+		req.Header.Set("If-Modified-Since", e.lastModified)
+	}
+}
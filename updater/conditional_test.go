@@ -0,0 +1,93 @@
+package updater
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestConditionalHashFetch(t *testing.T) {
+	tmp := t.TempDir()
+	writeTestRelease(t, path.Join(tmp, "files", "imqsbin"), map[string]string{"a.txt": "hello"})
+	files := http.StripPrefix("/files/", http.FileServer(http.Dir(path.Join(tmp, "files"))))
+	notModified, contentFetches := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) == ManifestFilename_Content {
+			contentFetches++
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		files.ServeHTTP(rec, r)
+		if rec.status == http.StatusNotModified {
+			notModified++
+		}
+	}))
+	defer server.Close()
+
+	u := newTestUpdater(t, tmp)
+	u.Config.DeployUrl = server.URL + "/files"
+	u.Config.BinDir.Remote.Path = "imqsbin"
+	u.beforeSync = nil
+	u.afterSync = nil
+	for i := 0; i < 3; i++ {
+		if err := u.fetch(&u.Config.BinDir); err != nil {
+			t.Fatal(err)
+		}
+		u.Apply()
+	}
+	if notModified != 2 {
+		t.Errorf("Expected the 2nd and 3rd checks to be answered with 304, but %v were", notModified)
+	}
+	if contentFetches != 1 {
+		t.Errorf("Expected manifest.content to be fetched once, but it was fetched %v times", contentFetches)
+	}
+	if readHashFile(u.Config.BinDir.LocalPathNext) != readHashFile(path.Join(tmp, "files", "imqsbin")) {
+		t.Errorf("Expected the hash from the 304 to stay staged")
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func TestRetryAfter(t *testing.T) {
+	retryAfter := "120"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, "busy", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.Config.DeployUrl = server.URL
+	u.Config.BinDir.Remote.Path = "imqsbin"
+	err := u.fetch(&u.Config.BinDir)
+	var ra *RetryAfterError
+	if !errors.As(err, &ra) || ra.After != 120*time.Second {
+		t.Fatalf("Expected a RetryAfterError of 120 seconds, but got %v", err)
+	}
+	now := time.Now()
+	u.Config.CheckIntervalSeconds = 10
+	if next := u.nextCheckAfter(&u.Config.BinDir, err, now); next.Before(now.Add(120 * time.Second)) {
+		t.Errorf("Expected to wait for at least 120 seconds, but the next check is at %v", next.Sub(now))
+	}
+	u.Config.CheckIntervalSeconds = 1000
+	if next := u.nextCheckAfter(&u.Config.BinDir, err, now); next.Before(now.Add(1000 * time.Second)) {
+		t.Errorf("A short Retry-After must not bring the next check forward")
+	}
+
+	retryAfter = now.Add(time.Hour).UTC().Format(http.TimeFormat)
+	err = u.fetch(&u.Config.BinDir)
+	if !errors.As(err, &ra) || ra.After < 59*time.Minute || ra.After > time.Hour {
+		t.Errorf("Expected a Retry-After date to be understood, but got %v", err)
+	}
+}
@@ -2,29 +2,71 @@ package updater
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"time"
 )
 
 // Updater configuration
 type Config struct {
-	DeployUrl              string  // https://deploy.imqs.co.za/files
-	BinDir                 SyncDir // c:/imqsbin
-	ConfDir                SyncDir // c:/imqsvar/conf
-	LogFile                string  // c:/imqsvar/logs/ImqsUpdater.log
-	CheckIntervalSeconds   float64 // 60 * 5
-	ServiceStopWaitSeconds float64 // 30
+	DeployUrl              string              // https://deploy.imqs.co.za/files
+	Mirrors                []Mirror            // Mirrors of DeployUrl (optional. If not empty, then these are used instead of DeployUrl)
+	MirrorFailureThreshold int                 // 3 (A mirror or peer that fails this many times in a row is taken out of use)
+	MirrorCooldownSeconds  float64             // 60 * 10 (How long a failing mirror or peer is taken out of use)
+	S3                     S3Config            // Used by SyncDirs whose remote path is s3://bucket/path
+	SyncDirs               []*SyncDir          // The directories that are synchronized. If empty, then BinDir and ConfDir are used.
+	BinDir                 SyncDir             // c:/imqsbin (Deprecated. Use SyncDirs)
+	ConfDir                SyncDir             // c:/imqsvar/conf (Deprecated. Use SyncDirs)
+	LogFile                string              // c:/imqsvar/logs/ImqsUpdater.log
+	CheckIntervalSeconds   float64             // 60 * 5
+	CheckJitterSeconds     float64             // 30 (A random delay of up to this much is added to every check, unless the SyncDir has its own JitterSeconds)
+	StartupDelaySeconds    float64             // 60 (Wait a random time of up to this much before the first check, so that machines that boot together don't all check together)
+	ServiceStopWaitSeconds float64             // 30
+	CheckinUrl             string              // https://deploy.imqs.co.za/checkin (optional. If empty, then no check-ins are sent)
+	CheckinToken           string              // Sent as a bearer token with every check-in (optional. Must match the -checkintoken of server-cmd)
+	MachineID              string              // Identifies this machine in check-ins (optional. Defaults to the hostname)
+	BundleDropDir          string              // c:/imqsvar/bundles (optional. Offline bundles dropped in here are imported automatically)
+	HashWorkers            int                 // 0 (Number of files that are hashed in parallel. 0 = one per CPU)
+	DisableHashCache       bool                // false (If true, then every file is rehashed whenever we build a manifest)
+	HashCacheRehashHours   float64             // 24 * 7 (Ignore the hash cache, and rehash everything, this often. 0 = never)
+	PeerListen             string              // :2016 (optional. If set, then we serve our content to LAN peers on this address)
+	Peers                  []string            // http://imqs-app1:2016 (optional. LAN peers that are tried before the real source)
+	PeerSecret             string              // Shared by all the updaters on the LAN (Required if PeerListen or Peers is set. Peers that don't send it are refused)
+	StateFile              string              // c:/imqsvar/ImqsUpdater.state.json (Remembers when each dir was last checked and applied. Empty = don't remember)
+	ArchiveDir             string              // c:/imqsvar/archive (Previous releases are kept here, for rollback. Empty = don't archive)
+	ArchiveKeep            int                 // 3 (Number of previous releases of each dir that are kept in ArchiveDir)
+	MaintenanceWindows     []MaintenanceWindow // Releases are only installed during these windows (optional. Empty = at any time). See maintenance.go.
+	DiskSpaceMarginMB      float64             // 500 (Don't stage or install a release unless this much disk space will still be free afterwards)
+	JournalFile            string              // c:/imqsvar/logs/ImqsUpdater.journal (Every apply appends a line of JSON here, with its outcome. Empty = no journal)
+	DisableSnapshots       bool                // false (If true, then dirs are not snapshotted before they are installed. This saves a copy of every dir, but a failed install is left half-done.)
+
+	maintenanceWindows []*maintenanceWindow // MaintenanceWindows, parsed by validateMaintenanceWindows
 }
 
 // Create a new Config with defaults set
 func NewConfig() *Config {
 	c := new(Config)
 	c.DeployUrl = "https://deploy.imqs.co.za/files"
+	c.MirrorFailureThreshold = 3
+	c.MirrorCooldownSeconds = 60 * 10
+	c.BinDir.Name = "bin"
+	c.BinDir.ServiceListFile = "servicenames"
+	c.ConfDir.Name = "conf"
+	c.ConfDir.ServicesFrom = []string{"bin"}
 	c.BinDir.Remote.Path = "imqsbin/stable"
 	c.BinDir.LocalPath = "c:/imqsbin"
 	c.BinDir.LocalPathNext = "c:/imqsbin_next"
 	c.LogFile = "c:/imqsvar/logs/ImqsUpdater.log"
+	c.StateFile = "c:/imqsvar/ImqsUpdater.state.json"
+	c.ArchiveDir = "c:/imqsvar/archive"
+	c.ArchiveKeep = 3
+	c.DiskSpaceMarginMB = 500
+	c.JournalFile = "c:/imqsvar/logs/ImqsUpdater.journal"
 	c.CheckIntervalSeconds = 60 * 5
+	c.CheckJitterSeconds = 30
+	c.StartupDelaySeconds = 60
 	c.ServiceStopWaitSeconds = 30
+	c.HashCacheRehashHours = 24 * 7
 	return c
 }
 
@@ -38,10 +80,20 @@ func (c *Config) LoadFile(filename string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := c.validateSyncDirs(); err != nil {
+		return err
+	}
+	if err := c.validatePeers(); err != nil {
+		return err
+	}
+	return c.validateMaintenanceWindows()
 }
 
+// Returns SyncDirs, or for older configs, BinDir and ConfDir
 func (c *Config) allSyncDirs() []*SyncDir {
+	if len(c.SyncDirs) != 0 {
+		return c.SyncDirs
+	}
 	if c.ConfDir.LocalPath != "" {
 		return []*SyncDir{&c.BinDir, &c.ConfDir}
 	} else {
@@ -49,3 +101,54 @@ func (c *Config) allSyncDirs() []*SyncDir {
 		return []*SyncDir{&c.BinDir}
 	}
 }
+
+// Returns the SyncDir with the given name, or nil
+func (c *Config) syncDirByName(name string) *SyncDir {
+	for _, s := range c.allSyncDirs() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateSyncDirs() error {
+	names := map[string]bool{}
+	for i, s := range c.allSyncDirs() {
+		if s == nil {
+			return fmt.Errorf("SyncDirs[%v] is empty", i)
+		}
+		if s.Name == "" || names[s.Name] {
+			return fmt.Errorf("SyncDirs[%v] needs a unique Name", i)
+		}
+		names[s.Name] = true
+		if s.LocalPath == "" || s.LocalPathNext == "" || s.Remote.Path == "" {
+			return fmt.Errorf("SyncDir %v needs a LocalPath, LocalPathNext and Remote.Path", s.Name)
+		}
+		if sameLocalPath(s.LocalPath, s.LocalPathNext) {
+			return fmt.Errorf("SyncDir %v has the same LocalPath and LocalPathNext", s.Name)
+		}
+		if s.Schedule != "" {
+			if _, err := parseCron(s.Schedule); err != nil {
+				return fmt.Errorf("SyncDir %v: %v", s.Name, err)
+			}
+		}
+	}
+	for _, s := range c.allSyncDirs() {
+		for _, other := range s.ServicesFrom {
+			if !names[other] {
+				return fmt.Errorf("SyncDir %v takes services from %v, but there is no SyncDir called %v", s.Name, other, other)
+			}
+		}
+	}
+	return nil
+}
+
+// How often syncDir is checked
+func (c *Config) checkInterval(syncDir *SyncDir) time.Duration {
+	seconds := syncDir.CheckIntervalSeconds
+	if seconds <= 0 {
+		seconds = c.CheckIntervalSeconds
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,106 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, body string) (*Config, error) {
+	filename := path.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(filename, []byte(body), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c := NewConfig()
+	return c, c.LoadFile(filename)
+}
+
+func TestLegacyConfigLoadsAsSyncDirs(t *testing.T) {
+	c, err := loadTestConfig(t, `{"BinDir": {"LocalPath": "/x/bin", "LocalPathNext": "/x/bin_next"}, "ConfDir": {"Remote": {"Path": "imqsconf/stable"}, "LocalPath": "/x/conf", "LocalPathNext": "/x/conf_next"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := c.allSyncDirs()
+	if len(dirs) != 2 || dirs[0].Name != "bin" || dirs[1].Name != "conf" || dirs[0].Remote.Path != "imqsbin/stable" {
+		t.Fatalf("Unexpected dirs %+v", dirs)
+	}
+	if dirs[0].ServiceListFile != "servicenames" || !reflect.DeepEqual(dirs[1].ServicesFrom, []string{"bin"}) {
+		t.Errorf("Legacy dirs must keep their service behaviour")
+	}
+}
+
+func TestSyncDirsConfig(t *testing.T) {
+	c, err := loadTestConfig(t, `{"SyncDirs": [
+		{"Name": "bin", "Remote": {"Path": "imqsbin/stable"}, "LocalPath": "/x/bin", "LocalPathNext": "/x/bin_next"},
+		{"Name": "maps", "Remote": {"Path": "maps/za", "Username": "u"}, "LocalPath": "/x/maps", "LocalPathNext": "/x/maps_next", "CheckIntervalSeconds": 3600}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := c.allSyncDirs()
+	if len(dirs) != 2 || c.syncDirByName("maps") != dirs[1] || dirs[1].Remote.Username != "u" {
+		t.Fatalf("Unexpected dirs %+v", dirs)
+	}
+	if c.checkInterval(dirs[0]) != c.checkInterval(&c.BinDir) || c.checkInterval(dirs[1]).Hours() != 1 {
+		t.Errorf("Unexpected check intervals")
+	}
+
+	for _, bad := range []string{
+		`{"SyncDirs": [{"Remote": {"Path": "a"}, "LocalPath": "/a", "LocalPathNext": "/a_next"}]}`,
+		`{"SyncDirs": [{"Name": "a", "Remote": {"Path": "a"}, "LocalPath": "/a", "LocalPathNext": "/a_next"}, {"Name": "a", "Remote": {"Path": "b"}, "LocalPath": "/b", "LocalPathNext": "/b_next"}]}`,
+		`{"SyncDirs": [{"Name": "a", "Remote": {"Path": "a"}, "LocalPath": "/a"}]}`,
+		`{"SyncDirs": [{"Name": "a", "Remote": {"Path": "a"}, "LocalPath": "/a", "LocalPathNext": "/a_next", "ServicesFrom": ["b"]}]}`,
+	} {
+		if _, err := loadTestConfig(t, bad); err == nil {
+			t.Errorf("Expected config to be rejected: %v", bad)
+		}
+	}
+}
+
+func TestServiceNamesOf(t *testing.T) {
+	tmp := t.TempDir()
+	c := NewConfig()
+	bin := &SyncDir{Name: "bin", LocalPath: path.Join(tmp, "bin"), LocalPathNext: path.Join(tmp, "bin_next"), ServiceListFile: "servicenames"}
+	conf := &SyncDir{Name: "conf", LocalPath: path.Join(tmp, "conf"), ServicesFrom: []string{"bin"}}
+	maps := &SyncDir{Name: "maps", LocalPath: path.Join(tmp, "maps"), Services: []string{"ImqsMaps"}, ServicesFrom: []string{"maps"}}
+	c.SyncDirs = []*SyncDir{bin, conf, maps}
+	os.MkdirAll(bin.LocalPath, 0777)
+	os.MkdirAll(bin.LocalPathNext, 0777)
+	ioutil.WriteFile(path.Join(bin.LocalPath, "servicenames"), []byte("ImqsAuth\nImqsMaps\n"), 0666)
+	ioutil.WriteFile(path.Join(bin.LocalPathNext, "servicenames"), []byte("ImqsAuth\r\nImqsNew\r\n"), 0666)
+
+	next := func(s *SyncDir) string { return s.LocalPathNext }
+	if names := serviceNamesOf(c, []*SyncDir{conf}, next); !reflect.DeepEqual(names, []string{"ImqsAuth", "ImqsMaps", "ImqsNew"}) {
+		t.Errorf("Unexpected services of conf: %v", names)
+	}
+	if names := serviceNamesOf(c, []*SyncDir{maps}, next); !reflect.DeepEqual(names, []string{"ImqsMaps"}) {
+		t.Errorf("Unexpected services of maps: %v", names)
+	}
+}
+
+func TestApplyHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Hooks in this test use sh")
+	}
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	dir := &u.Config.BinDir
+	os.MkdirAll(dir.LocalPath, 0777)
+	dir.BeforeApply = []string{"sh", "-c", "echo before > hook.txt"}
+	dir.AfterApply = []string{"sh", "-c", "echo after >> hook.txt"}
+	if err := beforeSyncImqs(u, []*SyncDir{dir}); err != nil {
+		t.Fatal(err)
+	}
+	afterSyncImqs(u, []*SyncDir{dir}, true)
+	if raw, _ := ioutil.ReadFile(path.Join(dir.LocalPath, "hook.txt")); string(raw) != "before\nafter\n" {
+		t.Errorf("Unexpected hook output %q", raw)
+	}
+
+	dir.BeforeApply = []string{"sh", "-c", "exit 3"}
+	if err := beforeSyncImqs(u, []*SyncDir{dir}); err == nil {
+		t.Errorf("A failing BeforeApply hook must abandon the update")
+	}
+}
@@ -0,0 +1,106 @@
+package updater
+
+// This deals with releases that must be installed together with a release of another SyncDir.
+//
+// Bin and conf are downloaded independently, so without coupling, a new bin release could be
+// applied while the conf release that it needs is still downloading. A release declares what it
+// needs in Manifest.Requires, which maps the remote path of another SyncDir (eg imqsconf/stable)
+// to the manifest hash that it must be at. A staged release is held back until every dir that it
+// requires is either installed at that hash, or staged at that hash and ready to apply.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Parse a comma separated list of remotePath=hash (eg "imqsconf/stable=9f86d0...").
+// Instead of a hash, a directory holding a release may be given, in which case its manifest.hash is used.
+func ParseRequires(spec string) (map[string]string, error) {
+	requires := map[string]string{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.LastIndex(item, "=")
+		if eq <= 0 || eq == len(item)-1 {
+			return nil, fmt.Errorf("Invalid requirement '%v'. Expected remotePath=hash", item)
+		}
+		remotePath, hash := normalizeRemotePath(item[:eq]), item[eq+1:]
+		if raw, err := ioutil.ReadFile(path.Join(hash, ManifestFilename_Hash)); err == nil {
+			hash = strings.TrimSpace(string(raw))
+		}
+		requires[remotePath] = strings.ToLower(hash)
+	}
+	return requires, nil
+}
+
+func normalizeRemotePath(remotePath string) string {
+	return strings.Trim(strings.TrimSpace(remotePath), "/")
+}
+
+// Returns the SyncDir whose Remote.Path is remotePath, or nil
+func (c *Config) syncDirForRemotePath(remotePath string) *SyncDir {
+	for _, s := range c.allSyncDirs() {
+		if normalizeRemotePath(s.Remote.Path) == normalizeRemotePath(remotePath) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Split 'ready' into the dirs that can be applied now, and the dirs that must wait for the release of
+// another dir. Holding back a dir can in turn hold back the dirs that require it, so we repeat until
+// nothing changes. The reason that each dir is held back is returned in 'held'.
+func (u *Updater) holdBackUncoupled(ready []*SyncDir) (apply []*SyncDir, held map[*SyncDir]string) {
+	held = map[*SyncDir]string{}
+	isReady := map[*SyncDir]bool{}
+	for _, dir := range ready {
+		isReady[dir] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, dir := range ready {
+			if !isReady[dir] {
+				continue
+			}
+			if reason := u.unmetRequirement(dir, isReady); reason != "" {
+				isReady[dir] = false
+				held[dir] = reason
+				changed = true
+			}
+		}
+	}
+	for _, dir := range ready {
+		if isReady[dir] {
+			apply = append(apply, dir)
+		}
+	}
+	return apply, held
+}
+
+// Returns the first requirement of the release staged in syncDir that will not be met after
+// the dirs in 'isReady' are applied, or an empty string if they are all met.
+func (u *Updater) unmetRequirement(syncDir *SyncDir, isReady map[*SyncDir]bool) string {
+	release, err := ReadManifest(syncDir.LocalPathNext)
+	if err != nil {
+		return ""
+	}
+	for remotePath, hash := range release.Requires {
+		other := u.Config.syncDirForRemotePath(remotePath)
+		if other == nil {
+			u.warnf("The release staged in %v requires %v, which is not synchronized here. Ignoring the requirement.", syncDir.LocalPathNext, remotePath)
+			continue
+		}
+		installed := readHashFile(other.LocalPath)
+		if isReady[other] {
+			installed = readHashFile(other.LocalPathNext)
+		}
+		if !strings.EqualFold(installed, hash) {
+			return fmt.Sprintf("Waiting for %v to be staged at %v (it is at %v)", other.LocalPath, describeHash(hash), describeHash(installed))
+		}
+	}
+	return ""
+}
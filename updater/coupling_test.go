@@ -0,0 +1,90 @@
+// +build !windows
+
+package updater
+
+import (
+	"path"
+	"testing"
+)
+
+func TestParseRequires(t *testing.T) {
+	tmp := t.TempDir()
+	writeTestRelease(t, tmp, map[string]string{"a.txt": "a"})
+	requires, err := ParseRequires("/imqsconf/stable/=ABC123, imqsdata=" + tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requires) != 2 || requires["imqsconf/stable"] != "abc123" || requires["imqsdata"] != readHashFile(tmp) {
+		t.Errorf("Unexpected requirements %v", requires)
+	}
+	for _, bad := range []string{"imqsconf", "=abc", "imqsconf="} {
+		if _, err := ParseRequires(bad); err == nil {
+			t.Errorf("Expected '%v' to be rejected", bad)
+		}
+	}
+}
+
+func TestRequiresIsNotPartOfHash(t *testing.T) {
+	m := &Manifest{Files: []ManifestFile{{Name: "a.txt", Hash: "00"}}}
+	plain := string(m.hash())
+	m.Requires = map[string]string{}
+	if m.extHash() != "" {
+		t.Error("An empty Requires must not need an ExtHash")
+	}
+	m.Requires["imqsconf/stable"] = "abc"
+	if string(m.hash()) != plain {
+		t.Error("Requires may not be part of the manifest hash, otherwise older updaters reject the release")
+	}
+	if m.extHash() == "" {
+		t.Error("Requires must be part of ExtHash")
+	}
+}
+
+func TestApplyWaitsForCoupledDir(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	bin := &u.Config.BinDir
+	conf := &u.Config.ConfDir
+	conf.LocalPath = path.Join(tmp, "conf")
+	conf.LocalPathNext = path.Join(tmp, "conf_next")
+	bin.Remote.Path = path.Join(tmp, "release", "bin")
+	conf.Remote.Path = path.Join(tmp, "release", "conf")
+
+	writeTestRelease(t, bin.Remote.Path, map[string]string{"app.exe": "one"})
+	writeTestRelease(t, conf.Remote.Path, map[string]string{"app.json": "one"})
+	u.Download()
+	u.Apply()
+
+	// Publish a bin release that needs a conf release which has not been published yet
+	writeTestRelease(t, path.Join(tmp, "conf_two"), map[string]string{"app.json": "two"})
+	confTwo := readHashFile(path.Join(tmp, "conf_two"))
+	writeTestRelease(t, bin.Remote.Path, map[string]string{"app.exe": "two"})
+	m, _ := ReadManifest(bin.Remote.Path)
+	m.Requires = map[string]string{conf.Remote.Path: confTwo}
+	if err := m.Write(bin.Remote.Path); err != nil {
+		t.Fatal(err)
+	}
+	binTwo := readHashFile(bin.Remote.Path)
+
+	u.Download()
+	u.Apply()
+	if readHashFile(bin.LocalPathNext) != binTwo {
+		t.Fatal("Expected the bin release to be staged")
+	}
+	if readHashFile(bin.LocalPath) == binTwo {
+		t.Fatal("Bin must wait for the conf release that it requires")
+	}
+	if st := u.Status(); st.Dirs[0].ReadyToApply || st.Dirs[0].NotReadyReason == "" {
+		t.Errorf("Expected status to explain why bin is held back, but got %+v", st.Dirs[0])
+	}
+
+	// Now publish the conf release, and both are installed together
+	writeTestRelease(t, conf.Remote.Path, map[string]string{"app.json": "two"})
+	u.Download()
+	u.Apply()
+	if readHashFile(bin.LocalPath) != binTwo || readHashFile(conf.LocalPath) != confTwo {
+		t.Fatal("Expected bin and conf to be installed together")
+	}
+}
@@ -0,0 +1,165 @@
+package updater
+
+// This deals with comparing two releases.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A file whose content (or link target, or executable bit) differs between two manifests
+type ManifestFileChange struct {
+	Name    string
+	OldHash string
+	NewHash string
+	OldSize int64
+	NewSize int64
+}
+
+// A file that moved, without its content changing
+type ManifestRename struct {
+	From string
+	To   string
+	Hash string
+	Size int64
+}
+
+// The difference between two manifests. Sizes are only known for manifests that record them.
+type ManifestDiff struct {
+	Added         []ManifestFile
+	Removed       []ManifestFile
+	Modified      []ManifestFileChange
+	Renamed       []ManifestRename
+	AddedDirs     []string
+	RemovedDirs   []string
+	AddedBytes    int64 // Total size of added files
+	RemovedBytes  int64 // Total size of removed files
+	ModifiedBytes int64 // Total size of modified files, in their new form
+}
+
+// Returns what it takes to turn 'a' into 'b'.
+// A file that is missing from 'b' is considered renamed if 'b' has a new file with the same hash.
+func DiffManifests(a, b *Manifest) *ManifestDiff {
+	d := &ManifestDiff{}
+	aByName := a.nameToFileMap()
+	bByName := b.nameToFileMap()
+	aByHash := a.hashToFileMap()
+	renamedFrom := map[string]bool{}
+
+	for _, f := range b.Files {
+		old := aByName[f.Name]
+		if old == nil {
+			if src := aByHash[f.Hash]; f.Link == "" && src != nil && bByName[src.Name] == nil && !renamedFrom[src.Name] {
+				renamedFrom[src.Name] = true
+				d.Renamed = append(d.Renamed, ManifestRename{From: src.Name, To: f.Name, Hash: f.Hash, Size: f.Size})
+			} else {
+				d.Added = append(d.Added, f)
+				d.AddedBytes += f.Size
+			}
+		} else if old.Hash != f.Hash || old.Link != f.Link || old.Exec != f.Exec {
+			d.Modified = append(d.Modified, ManifestFileChange{Name: f.Name, OldHash: old.Hash, NewHash: f.Hash, OldSize: old.Size, NewSize: f.Size})
+			d.ModifiedBytes += f.Size
+		}
+	}
+	for _, f := range a.Files {
+		if bByName[f.Name] == nil && !renamedFrom[f.Name] {
+			d.Removed = append(d.Removed, f)
+			d.RemovedBytes += f.Size
+		}
+	}
+
+	aDirs := a.nameToDirMap()
+	bDirs := b.nameToDirMap()
+	for _, dir := range b.Dirs {
+		if !aDirs[dir] {
+			d.AddedDirs = append(d.AddedDirs, dir)
+		}
+	}
+	for _, dir := range a.Dirs {
+		if !bDirs[dir] {
+			d.RemovedDirs = append(d.RemovedDirs, dir)
+		}
+	}
+
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].Name < d.Added[j].Name })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Name < d.Removed[j].Name })
+	sort.Slice(d.Modified, func(i, j int) bool { return d.Modified[i].Name < d.Modified[j].Name })
+	sort.Slice(d.Renamed, func(i, j int) bool { return d.Renamed[i].To < d.Renamed[j].To })
+	sort.Strings(d.AddedDirs)
+	sort.Strings(d.RemovedDirs)
+	return d
+}
+
+// Returns true if the two manifests describe the same release
+func (d *ManifestDiff) IsEmpty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Modified)+len(d.Renamed)+len(d.AddedDirs)+len(d.RemovedDirs) == 0
+}
+
+// Write a human readable listing of the differences, followed by a summary line
+func (d *ManifestDiff) WriteText(w io.Writer) {
+	for _, dir := range d.AddedDirs {
+		fmt.Fprintf(w, "+ %v/\n", dir)
+	}
+	for _, dir := range d.RemovedDirs {
+		fmt.Fprintf(w, "- %v/\n", dir)
+	}
+	for _, f := range d.Added {
+		fmt.Fprintf(w, "+ %v%v\n", f.Name, describeSize(f.Size))
+	}
+	for _, f := range d.Removed {
+		fmt.Fprintf(w, "- %v%v\n", f.Name, describeSize(f.Size))
+	}
+	for _, f := range d.Modified {
+		if f.OldSize != 0 || f.NewSize != 0 {
+			fmt.Fprintf(w, "M %v (%v -> %v bytes)\n", f.Name, f.OldSize, f.NewSize)
+		} else {
+			fmt.Fprintf(w, "M %v\n", f.Name)
+		}
+	}
+	for _, r := range d.Renamed {
+		fmt.Fprintf(w, "R %v -> %v\n", r.From, r.To)
+	}
+	fmt.Fprintf(w, "%v added (%v bytes), %v removed (%v bytes), %v modified (%v bytes), %v renamed, %v dirs added, %v dirs removed\n",
+		len(d.Added), d.AddedBytes, len(d.Removed), d.RemovedBytes, len(d.Modified), d.ModifiedBytes, len(d.Renamed), len(d.AddedDirs), len(d.RemovedDirs))
+}
+
+func describeSize(size int64) string {
+	if size == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%v bytes)", size)
+}
+
+// Load a manifest from a location, which can be:
+//
+//   - A manifest.content file
+//   - A directory, whose manifest is built from the files inside it
+//   - A remote path, as accepted by RemotePath.Path (eg a URL, s3:// URL, or a path relative to c.DeployUrl)
+func LoadManifest(location string, c *Config, client *http.Client) (*Manifest, error) {
+	if info, err := os.Stat(location); err == nil {
+		if info.IsDir() {
+			return BuildManifest(location)
+		}
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readManifestFrom(f)
+	}
+	remote := RemotePath{Path: strings.TrimSuffix(location, "/"+ManifestFilename_Content)}
+	src, err := newSource(c, remote, client)
+	if err != nil {
+		return nil, err
+	}
+	r, err := src.Open(ManifestFilename_Content)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readManifestFrom(r)
+}
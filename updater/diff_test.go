@@ -0,0 +1,79 @@
+package updater
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDiffManifests(t *testing.T) {
+	tmp := t.TempDir()
+	a := path.Join(tmp, "a")
+	b := path.Join(tmp, "b")
+	writeTestRelease(t, a, map[string]string{
+		"same.txt":     "same",
+		"changed.txt":  "old",
+		"gone.txt":     "gone",
+		"old/name.txt": "moved",
+	})
+	writeTestRelease(t, b, map[string]string{
+		"same.txt":     "same",
+		"changed.txt":  "newer",
+		"new.txt":      "new",
+		"new/name.txt": "moved",
+	})
+
+	ma, err := LoadManifest(path.Join(a, ManifestFilename_Content), NewConfig(), http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := LoadManifest(b, NewConfig(), http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := DiffManifests(ma, mb)
+	if len(d.Added) != 1 || d.Added[0].Name != "new.txt" || d.AddedBytes != 3 {
+		t.Errorf("Unexpected additions %v", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].Name != "gone.txt" {
+		t.Errorf("Unexpected removals %v", d.Removed)
+	}
+	if len(d.Modified) != 1 || d.Modified[0].Name != "changed.txt" || d.Modified[0].NewSize != 5 {
+		t.Errorf("Unexpected modifications %v", d.Modified)
+	}
+	if len(d.Renamed) != 1 || d.Renamed[0].From != "old/name.txt" || d.Renamed[0].To != "new/name.txt" {
+		t.Errorf("Unexpected renames %v", d.Renamed)
+	}
+	if len(d.AddedDirs) != 1 || d.AddedDirs[0] != "new" || len(d.RemovedDirs) != 1 || d.RemovedDirs[0] != "old" {
+		t.Errorf("Unexpected dirs %v %v", d.AddedDirs, d.RemovedDirs)
+	}
+
+	var buf bytes.Buffer
+	d.WriteText(&buf)
+	if !strings.Contains(buf.String(), "R old/name.txt -> new/name.txt") {
+		t.Errorf("Unexpected text output:\n%v", buf.String())
+	}
+	if !DiffManifests(mb, mb).IsEmpty() {
+		t.Errorf("Expected a manifest to be identical to itself")
+	}
+}
+
+func TestManifestSizeIsNotHashed(t *testing.T) {
+	tmp := t.TempDir()
+	ioutil.WriteFile(path.Join(tmp, "a.txt"), []byte("hello"), 0666)
+	m, err := BuildManifest(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Files[0].Size != 5 {
+		t.Errorf("Expected size 5, but got %v", m.Files[0].Size)
+	}
+	before := m.hash()
+	m.Files[0].Size = 0
+	if !bytes.Equal(before, m.hash()) {
+		t.Errorf("Size must not be part of the manifest hash")
+	}
+}
@@ -0,0 +1,153 @@
+package updater
+
+// This checks that there is enough disk space, before we stage or install a release.
+//
+// Running out of space half way through a release leaves a mess, so we work out up front how
+// many bytes will be written, from the sizes in the manifest. Staging needs space on the volume of
+// LocalPathNext for every file that is downloaded or copied. Installing needs space on the volume of
+// LocalPath for every file that is added or modified, because each one is written beside the old one
+// before it is renamed into place. Before installing, the current release is also copied into the
+// archive (on the volume of ArchiveDir), unless it is already there, and into its snapshot beside
+// LocalPath, unless snapshots are disabled. Those copies are counted too. Everything that an
+// apply writes is added up per volume, so that eg bin, conf and the archive on the same drive are
+// checked against its free space together. Manifests from before sizes were recorded count as zero
+// bytes, so only the margin protects them. Config.DiskSpaceMarginMB is kept free on top of what we need.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// There is not enough disk space to stage or install a release
+type InsufficientSpaceError struct {
+	Dir       string // The directory that we were going to write into
+	Needed    int64  // Bytes that we were going to write
+	Margin    int64  // Bytes that must be left free on top of Needed
+	Available int64  // Bytes that were free
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("Not enough disk space for %v: %v bytes are needed (plus a margin of %v bytes), but only %v bytes are free", e.Dir, e.Needed, e.Margin, e.Available)
+}
+
+// Returns an InsufficientSpaceError if the volume of 'dir' does not have room for 'needed' bytes plus the margin.
+// If the free space cannot be determined, then we carry on, because the check is only a precaution.
+func (u *Updater) checkDiskSpace(dir string, needed int64) error {
+	margin := int64(u.Config.DiskSpaceMarginMB * 1024 * 1024)
+	if needed == 0 && margin == 0 {
+		return nil
+	}
+	available, err := u.freeDiskSpace(existingParent(dir))
+	if err != nil {
+		u.log.Warnf("Unable to determine the free disk space of %v: %v", dir, err)
+		return nil
+	}
+	if available < needed+margin {
+		return &InsufficientSpaceError{
+			Dir:       dir,
+			Needed:    needed,
+			Margin:    margin,
+			Available: available,
+		}
+	}
+	return nil
+}
+
+// Check that LocalPathNext has room for 'plan'
+func (u *Updater) checkStagingSpace(syncDir *SyncDir, plan *StagingPlan) error {
+	err := u.checkDiskSpace(syncDir.LocalPathNext, plan.DownloadBytes+plan.CopyBytes)
+	u.recordDiskSpace(syncDir, err)
+	return err
+}
+
+// Returns dir, or its nearest parent that exists, because the space is checked before dir is created
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// Returns the number of bytes that are written when turning 'from' into 'to'
+func installBytes(from, to *Manifest) int64 {
+	diff := DiffManifests(from, to)
+	needed := diff.AddedBytes + diff.ModifiedBytes
+	for _, r := range diff.Renamed {
+		needed += r.Size
+	}
+	return needed
+}
+
+// Check that there is room for everything that installing 'dirs' together will write: each release that
+// is staged in LocalPathNext, the snapshot of each current release if 'snapshot' is true, and the copy of
+// each current release that goes into ArchiveDir. These are added up per volume, because several of
+// them are usually on the same drive, and then each volume is checked once.
+func (u *Updater) checkInstallSpace(dirs []*SyncDir, snapshot bool) error {
+	type volumeNeed struct {
+		dir    string // The first dir on the volume, which is named in an InsufficientSpaceError
+		needed int64
+	}
+	volumes := map[string]*volumeNeed{}
+	order := []string{}
+	add := func(dir string, needed int64) {
+		vol := u.volumeOf(dir)
+		if volumes[vol] == nil {
+			volumes[vol] = &volumeNeed{dir: dir}
+			order = append(order, vol)
+		}
+		volumes[vol].needed += needed
+	}
+
+	for _, syncDir := range dirs {
+		next, err := ReadManifest(syncDir.LocalPathNext)
+		if err != nil {
+			return err
+		}
+		current, err := ReadManifest(syncDir.LocalPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			current = &Manifest{}
+		}
+		needed := installBytes(current, next)
+		if snapshot {
+			snapshotted, err := ReadManifest(snapshotPath(syncDir))
+			if err != nil {
+				// The snapshot is missing, or is not a complete copy, so it will be copied in full
+				snapshotted = &Manifest{}
+			}
+			needed += installBytes(snapshotted, current)
+		}
+		add(syncDir.LocalPath, needed)
+		if u.willArchive(syncDir) {
+			add(u.Config.ArchiveDir, installBytes(&Manifest{}, current))
+		}
+	}
+
+	var err error
+	for _, vol := range order {
+		if err = u.checkDiskSpace(volumes[vol].dir, volumes[vol].needed); err != nil {
+			break
+		}
+	}
+	for _, syncDir := range dirs {
+		u.recordDiskSpace(syncDir, err)
+	}
+	return err
+}
+
+// Remember the outcome of a disk space check in the state file, so that status and check-ins report it
+func (u *Updater) recordDiskSpace(syncDir *SyncDir, err error) {
+	insufficient, _ := err.(*InsufficientSpaceError)
+	u.updateState(func(s *State) {
+		s.dir(syncDir).InsufficientSpace = insufficient
+	})
+}
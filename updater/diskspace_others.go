@@ -0,0 +1,26 @@
+// +build !windows
+
+package updater
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Returns the number of bytes that we may still write to the volume that holds dir
+func freeDiskSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// Returns the device that holds dir, or dir itself if that cannot be determined
+func volumeOf(dir string) string {
+	var st syscall.Stat_t
+	if err := syscall.Stat(existingParent(dir), &st); err != nil {
+		return dir
+	}
+	return fmt.Sprintf("dev:%v", st.Dev)
+}
@@ -0,0 +1,160 @@
+// +build !windows
+
+package updater
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFreeDiskSpace(t *testing.T) {
+	if free, err := freeDiskSpace(t.TempDir()); err != nil || free <= 0 {
+		t.Errorf("Expected some free space, but got %v, %v", free, err)
+	}
+}
+
+func TestDiskSpacePreflight(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	u.Config.DiskSpaceMarginMB = 1
+	free := int64(0)
+	u.freeDiskSpace = func(dir string) (int64, error) {
+		return free, nil
+	}
+	dir := &u.Config.BinDir
+	dir.Remote.Path = path.Join(tmp, "release")
+	writeTestRelease(t, dir.Remote.Path, map[string]string{"big.bin": strings.Repeat("x", 1000)})
+
+	// Not enough room to stage
+	free = 1024*1024 + 999
+	if err := u.fetch(dir); !errors.As(err, new(*InsufficientSpaceError)) {
+		t.Fatalf("Expected InsufficientSpaceError, but got %v", err)
+	}
+	if _, err := ioutil.ReadFile(path.Join(dir.LocalPathNext, "big.bin")); err == nil {
+		t.Fatal("Nothing may be staged when there is not enough space")
+	}
+	if st := u.Status(); st.Dirs[0].InsufficientSpace == nil || st.Dirs[0].InsufficientSpace.Needed != 1000 {
+		t.Errorf("Expected status to report the shortage, but got %+v", st.Dirs[0].InsufficientSpace)
+	}
+	if c := u.buildCheckin(); c.Dirs[0].InsufficientSpace == nil {
+		t.Errorf("Expected the check-in to report the shortage")
+	}
+
+	// Enough room to stage, but by the time we install, the space is gone
+	free = 1024*1024 + 1000
+	if err := u.fetch(dir); err != nil {
+		t.Fatal(err)
+	}
+	if u.readState().dir(dir).InsufficientSpace != nil {
+		t.Errorf("A successful check must clear the shortage")
+	}
+	free = 1024 * 1024
+	u.Apply()
+	if readHashFile(dir.LocalPath) != "" {
+		t.Fatal("Release may not be installed when there is not enough space")
+	}
+	journal := readTestJournal(t, u)
+	if len(journal) != 1 || journal[0].Outcome != JournalAborted {
+		t.Errorf("Expected the apply to be journalled as aborted, but got %+v", journal)
+	}
+
+	free = 1024*1024 + 1000
+	u.Apply()
+	if readHashFile(dir.LocalPath) != readHashFile(dir.Remote.Path) {
+		t.Fatal("Expected the release to be installed once there is space")
+	}
+}
+
+func TestInstallSpaceIncludesArchiveAndSnapshot(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	u.Config.DiskSpaceMarginMB = 0
+	dir := &u.Config.BinDir
+	dir.Remote.Path = path.Join(tmp, "release")
+	writeTestRelease(t, dir.Remote.Path, map[string]string{"old.bin": strings.Repeat("x", 1000)})
+	u.Download()
+	u.Apply()
+	writeTestRelease(t, dir.Remote.Path, map[string]string{"new.bin": strings.Repeat("y", 300)})
+	u.Download()
+	if err := os.MkdirAll(u.Config.ArchiveDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every dir is on a volume of its own, with plenty of room, unless it is listed here
+	u.volumeOf = func(dir string) string {
+		return dir
+	}
+	free := map[string]int64{}
+	u.freeDiskSpace = func(dir string) (int64, error) {
+		if f, ok := free[dir]; ok {
+			return f, nil
+		}
+		return 1 << 40, nil
+	}
+	expectShort := func(snapshot bool, shortDir string, needed int64) {
+		t.Helper()
+		var ise *InsufficientSpaceError
+		if err := u.checkInstallSpace([]*SyncDir{dir}, snapshot); !errors.As(err, &ise) || ise.Dir != shortDir || ise.Needed != needed {
+			t.Errorf("Expected %v to be short of %v bytes, but got %v", shortDir, needed, err)
+		}
+	}
+
+	// The current release is not archived yet, so the archive needs room for all of it
+	free[u.Config.ArchiveDir] = 999
+	expectShort(false, u.Config.ArchiveDir, 1000)
+	free[u.Config.ArchiveDir] = 1000
+	free[dir.LocalPath] = 300
+	if err := u.checkInstallSpace([]*SyncDir{dir}, false); err != nil {
+		t.Errorf("Expected enough space, but got %v", err)
+	}
+
+	// A snapshot of the current release is written beside LocalPath
+	expectShort(true, dir.LocalPath, 1300)
+
+	// Once the release is archived, the archive needs no more room
+	if err := u.archiveCurrent(dir); err != nil {
+		t.Fatal(err)
+	}
+	free[u.Config.ArchiveDir] = 0
+	if err := u.checkInstallSpace([]*SyncDir{dir}, false); err != nil {
+		t.Errorf("Expected enough space, but got %v", err)
+	}
+}
+
+func TestInstallSpaceIsAddedUpPerVolume(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.Config.DiskSpaceMarginMB = 0
+	bin := &SyncDir{LocalPath: path.Join(tmp, "bin"), LocalPathNext: path.Join(tmp, "bin.next")}
+	conf := &SyncDir{LocalPath: path.Join(tmp, "conf"), LocalPathNext: path.Join(tmp, "conf.next")}
+	writeTestRelease(t, bin.LocalPathNext, map[string]string{"app.exe": strings.Repeat("x", 300)})
+	writeTestRelease(t, conf.LocalPathNext, map[string]string{"app.conf": strings.Repeat("y", 200)})
+
+	// Both dirs are on the same volume
+	u.volumeOf = func(dir string) string {
+		return "c:"
+	}
+	free := int64(499)
+	u.freeDiskSpace = func(dir string) (int64, error) {
+		return free, nil
+	}
+	var ise *InsufficientSpaceError
+	if err := u.checkInstallSpace([]*SyncDir{bin, conf}, false); !errors.As(err, &ise) || ise.Needed != 500 {
+		t.Fatalf("Expected the volume to be short of 500 bytes, but got %v", err)
+	}
+	if msg := ise.Error(); msg != "Not enough disk space for "+bin.LocalPath+": 500 bytes are needed (plus a margin of 0 bytes), but only 499 bytes are free" {
+		t.Errorf("Unexpected message %v", msg)
+	}
+	free = 500
+	if err := u.checkInstallSpace([]*SyncDir{bin, conf}, false); err != nil {
+		t.Errorf("Expected enough space, but got %v", err)
+	}
+}
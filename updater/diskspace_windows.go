@@ -0,0 +1,37 @@
+package updater
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// Returns the number of bytes that we may still write to the volume that holds dir.
+// This honours disk quotas, because it is the space available to the calling user.
+func freeDiskSpace(dir string) (int64, error) {
+	name, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&available)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+	if r == 0 {
+		return 0, err
+	}
+	return int64(available), nil
+}
+
+// Returns the drive (eg "c:") or network share that holds dir, or dir itself if that cannot be determined
+func volumeOf(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	if vol := filepath.VolumeName(abs); vol != "" {
+		return strings.ToLower(vol)
+	}
+	return dir
+}
@@ -38,6 +38,15 @@ out the old directory for the new, and the server starts to serve up a new relea
 
 An example URL for an imqsbin directory is https://deploy.imqs.co.za/files/imqsbin/stable
 
+S3-compatible storage can also be used, by publishing with "updater-cmd publish-s3", and
+pointing a SyncDir at s3://bucket/path. The publisher gets around the atomicity problem by
+uploading every release under its own prefix (s3://bucket/path/<hash>/), and only then
+overwriting s3://bucket/path/manifest.hash, which tells clients where to read from. A client
+therefore never sees a hash whose content is not fully uploaded, and a client that is busy
+downloading the previous release keeps reading from the previous prefix. Unchanged files are
+copied from the previous release inside S3. Old releases are never deleted by the publisher,
+so give the bucket a lifecycle rule that expires them.
+
 The Downloader
 
 The downloader runs as a Windows Service. It wakes up every 3 minutes, and checks for
@@ -52,6 +61,165 @@ a new release. If the hashes are consistent, then the downloader stops all servi
 and mirrors the staging directory onto the real directory. It then runs install.rb,
 and restarts all services.
 
+Every path in a downloaded manifest is validated before it is used. Absolute paths, '..',
+duplicates, names that differ only by case, reserved Windows names, and a path that is both a
+file and a directory are all rejected with a ManifestPathError.
+
+Check-ins
+
+If Config.CheckinUrl is set, then after every cycle the updater POSTs a small JSON report to that
+URL, with Config.CheckinToken as a bearer token. The report contains the machine ID, the hostname,
+the current and staged manifest.hash of every synchronized directory, the last error, and the
+updater version. server-cmd can receive these check-ins (only with the right token, if it is given
+-checkintoken), and produce a listing of the fleet, which highlights stragglers (machines that are
+not on the latest release) and failing machines. server-cmd only knows the latest release of the
+remote paths that it serves itself, so directories with an absolute remote path, or a file://,
+http:// or s3:// URL, are listed without a verdict, and never make a machine a straggler.
+
+Compression
+
+"updater-cmd -compress buildmanifest" writes a compressed sibling next to every file that compresses
+well, and lists them in manifest.compressed. The siblings are gzip (foo.gz), or with -compression zstd,
+zstd (foo.zst). Clients ask for either, and decompress before hashing, so a hash in the manifest always
+refers to the uncompressed bytes. If a decompressed file does not match its hash, because a sibling
+is stale, then the client downloads the file itself instead. Servers must serve the siblings with
+"Content-Encoding: gzip" or "Content-Encoding: zstd", which is what server-cmd does. nginx's
+"gzip_static on" only does this for gzip, and older updaters only ask for gzip.
+
+LAN peers
+
+Sites often have several servers behind the same slow link. If Config.PeerListen is set, then an
+updater serves the files of the synchronized directories that have ServeToPeers set to other
+updaters on the LAN, by hash. Peers get these files without the credentials of the directory's
+Remote, so serving is off by default, and every request must carry Config.PeerSecret, which all the
+updaters on the LAN share. Updaters that list it in Config.Peers try it first for every file, before
+going to the deploy server. Files from peers are checked against the manifest hash, just like any
+other download. A peer that fails (or serves a file that does not match its hash)
+MirrorFailureThreshold times in a row is not used for MirrorCooldownSeconds, so a peer that is
+switched off does not slow down every download.
+
+Comparing releases
+
+"updater-cmd diff A B" lists the files that were added, removed, modified or renamed (a file
+that moved without changing keeps its hash), and the directories that were added or removed,
+between two releases. A and B can be manifest files, directories, or remote paths. Use -json
+for machine-readable output.
+
+"updater-cmd verify <dir>" rebuilds the manifest of an installed directory, and lists the files
+that were modified, removed or added since the updater installed it. With -repair, the release
+is fetched from the remote again, and installed over the top.
+
+"updater-cmd plan" shows what the next download and apply would do: per synchronized directory,
+the files that would be downloaded, copied from the current release, deleted or left alone,
+the expected download size, and the services that would be stopped. The remote manifests are
+fetched into a temporary directory, so LocalPath and LocalPathNext are not changed.
+
+"updater-cmd status" answers the question "is this machine up to date?". It shows the current,
+staged and remote hash of every synchronized directory, whether the staged release is ready
+to apply (and if not, why not), when each directory was last checked and applied (from
+Config.StateFile), and which services are running. The exit code is 0 when everything is up
+to date, 2 when an update is pending, and 1 on error, so that monitoring scripts can use it.
+
+Rollback
+
+Before a release is replaced, it is copied into Config.ArchiveDir, which keeps the last
+Config.ArchiveKeep releases of every directory. Every archived release is a full copy, so set
+ArchiveDir to empty to turn archiving off. "updater-cmd rollback" stages the most recent
+archived release (or with -to, a specific one) into LocalPathNext, and installs it through the
+normal apply path, including stopping and starting services. It holds the same lock files as the
+service does while downloading or installing a directory, so the two never work on it at once.
+Automatic updates are then paused, because otherwise the next cycle would install the latest
+release again. Rolling back again, without -to, goes back one more release, rather than returning
+to the release that the first rollback replaced. "updater-cmd resume" resumes automatic updates.
+
+Synchronized directories
+
+Config.SyncDirs lists the directories that are kept up to date, each with a unique Name, its own
+remote path and credentials, and its own schedule. While a directory is installed, the services in
+its Services list and in its ServiceListFile (a file in the release, one service per line) are
+stopped, along with the services of the directories named in ServicesFrom. BeforeApply runs once
+those services are stopped, and a failure abandons the update. AfterApply runs before they are
+started again, unless the install failed and was rolled back. Older configs, which have BinDir and
+ConfDir instead of SyncDirs, still work: they behave as a "bin" dir whose services are listed in
+servicenames, and a "conf" dir that takes its services from bin.
+
+Schedules
+
+Each directory is checked by its own goroutine, either every CheckIntervalSeconds, or when its
+Schedule (a five field cron expression, such as "30 2 * * *") says so. JitterSeconds (by default
+Config.CheckJitterSeconds) adds a random delay to each check, and the first check after startup
+waits for a random time of up to Config.StartupDelaySeconds, so that machines which reboot together
+don't all hit the server together. The server can push clients back by answering with 429 or 503 and
+a Retry-After header. manifest.hash is fetched with a conditional GET, so when nothing has changed,
+the server only needs to answer 304 Not Modified. Downloads of different directories run side by
+side, but applies are never run at the same time, because they stop services. A directory is not
+applied while it is still downloading.
+
+Maintenance windows
+
+Config.MaintenanceWindows limits the times at which releases are installed, because installing
+a release restarts services. Each window has the days on which it opens, a start and end time
+(which may run past midnight), and a timezone. Downloads happen regardless, and a staged release
+waits for the next window. A release built with "updater-cmd buildmanifest -urgent" is installed
+right away, and "updater-cmd apply -force" ignores the windows.
+
+Disk space
+
+Before a release is staged, the sizes in its manifest tell us how much will be downloaded or copied
+into LocalPathNext. Before it is installed, they tell us how much will be written into LocalPath,
+and how much the copies of the current release in ArchiveDir and in its snapshot (see below) will
+take. These are added up per volume, over all the directories that are installed together. If any
+volume would be left with less than Config.DiskSpaceMarginMB free, then we stop with an
+InsufficientSpaceError, before anything is staged, or before the archive, the snapshot and the
+install are started. The updater has no metrics of its own, so the shortage is kept in the state
+file instead, and reported by "updater-cmd status" and in check-ins, until a later check succeeds.
+
+Transactional apply
+
+When several directories are ready at once (eg bin and conf), they are installed as a unit. Each
+directory is first mirrored into a snapshot beside it (eg c:/imqsbin.snapshot), which is kept for
+the next apply, and so needs as much disk space as the directory itself. If any directory then fails
+to mirror, all of them are restored from their snapshots before services are started again, so new
+binaries never run with old config, and a directory that is installed on its own is never left
+half-installed. Config.DisableSnapshots saves the space, at the cost of leaving a failed directory
+as it is. The outcome of every apply is appended to Config.JournalFile, as one line of JSON.
+
+Coupled releases
+
+A release can require a release of another directory, so that eg a bin release is never installed
+without the conf release that it was built for.
+"updater-cmd buildmanifest -require imqsconf/stable=<hash>" records this in Manifest.Requires, which
+is protected by Manifest.ExtHash (see Symlinks and executables). A staged release is held back until
+each directory that it requires is installed at that hash, or is staged at that hash and ready to be
+applied with it. Requirements on directories that are not synchronized are ignored, with a warning.
+
+Symlinks and executables
+
+Symlinks are recorded in the manifest as links, and are recreated by the client, rather than being
+followed. A link may not point outside of its directory. On unix, the executable bit is recorded
+too, and the mirror step preserves modes, modification times and links, so that binaries stay
+runnable after an update. Windows has no executable bit, so there it is taken on trust from the
+manifest. Links, the executable bit, Manifest.Requires and Manifest.Urgent are not part of
+manifest.hash, because older updaters would then reject every release that has them, including the
+one that upgrades them. They are hashed into Manifest.ExtHash instead, inside manifest.content. A
+release that only changes a link, an executable bit, a requirement or urgency therefore keeps its
+manifest.hash, so it must be published with a change of content to reach clients that already have
+it.
+
+Local-only files
+
+Sites keep logs, caches and per-site overrides inside synchronized directories. Paths that
+match SyncDir.Ignore, or a .updaterignore file (in .gitignore syntax) in the root of LocalPath,
+are invisible to the updater. They are never part of a manifest, and they are never deleted
+by staging or by the mirror step. A path that is part of the release is never ignored.
+
+Offline bundles
+
+Sites without internet are updated from bundles. "updater-cmd export-bundle" packs a release,
+together with its manifest, into a .tar.gz file. "updater-cmd import-bundle" checks the bundle
+against its manifest, and stages it into LocalPathNext, from where the normal apply phase
+installs it. Bundles that are dropped into Config.BundleDropDir are imported automatically.
+
 Non-sync tasks
 
 Most of the job of the updater is simply to get new files downloaded. However, there
@@ -60,6 +228,13 @@ The updater manages this by allowing one to define pre-update and post-update fu
 These two functions are used to perform tasks such as stopping and starting services,
 as well as running our universal install script "install.rb".
 
+Chunked files
+
+"updater-cmd -chunkmb N buildmanifest" splits every file of at least N MB into content-defined
+chunks, and lists the chunks in the manifest. When such a file changes, the client reuses the
+chunks that it already has in its old copy of the file, and fetches only the missing chunks,
+with ranged reads. The whole file is still verified against its hash at the end.
+
 Infra-file diffs
 
 It might be worthwhile integrating binary diffs into this system, so that one doesn't need
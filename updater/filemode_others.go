@@ -0,0 +1,30 @@
+// +build !windows
+
+package updater
+
+import (
+	"os"
+)
+
+// Unix file systems record the executable bit
+const execBitSupported = true
+
+// Set or clear the executable bits of filename. Execute permission is given to whoever can read the file.
+func setExecBit(filename string, exec bool) error {
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	mode := info.Mode().Perm()
+	want := mode &^ 0111
+	if exec {
+		want |= (mode & 0444) >> 2
+	}
+	if want == mode {
+		return nil
+	}
+	return os.Chmod(filename, want)
+}
@@ -0,0 +1,138 @@
+// +build !windows
+
+package updater
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestPlainManifestHashIsUnchanged(t *testing.T) {
+	m := &Manifest{Files: []ManifestFile{{Name: "a.txt", Hash: "abc"}}, Dirs: []string{"d"}}
+	expect := sha256.Sum256([]byte("a.txtabcd"))
+	if string(m.hash()) != string(expect[:]) {
+		t.Errorf("Manifest hash without links or executables must not change")
+	}
+	if m.extHash() != "" {
+		t.Errorf("Expected no ExtHash without links or executables")
+	}
+	m.Files[0].Exec = true
+	if string(m.hash()) != string(expect[:]) {
+		t.Errorf("Exec may not be part of the manifest hash, otherwise older updaters reject the release")
+	}
+	if m.extHash() == "" {
+		t.Errorf("Exec must be part of ExtHash")
+	}
+}
+
+// A release with links and executables must hash exactly as the first version of the updater hashed it,
+// which was over the names and hashes of the files, followed by the names of the dirs.
+func TestReleaseHashesAsBefore(t *testing.T) {
+	tmp := t.TempDir()
+	writeTestRelease(t, tmp, map[string]string{"bin/app": "app", "lib/x.so": "x"})
+	if err := os.Symlink("../lib/x.so", path.Join(tmp, "bin/x.so")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(tmp, "bin/app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write(tmp); err != nil {
+		t.Fatal(err)
+	}
+	legacy := sha256.New()
+	for _, f := range m.Files {
+		legacy.Write([]byte(f.Name + f.Hash))
+	}
+	for _, d := range m.Dirs {
+		legacy.Write([]byte(d))
+	}
+	if readHashFile(tmp) != hex.EncodeToString(legacy.Sum(nil)) {
+		t.Fatal("manifest.hash must be the hash that older updaters compute")
+	}
+	if err := isManifestPairConsistent(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Links and exec bits are still protected, by ExtHash
+	raw, err := ioutil.ReadFile(path.Join(tmp, ManifestFilename_Content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(raw), `"Exec": true`, `"Exec": false`, 1)
+	if err := ioutil.WriteFile(path.Join(tmp, ManifestFilename_Content), []byte(tampered), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := isManifestPairConsistent(tmp); err != ErrManifestInconsistent {
+		t.Errorf("Expected a changed Exec to make the manifest inconsistent, but got %v", err)
+	}
+}
+
+func TestLinkMayNotEscape(t *testing.T) {
+	for _, link := range []string{"../x", "a/../../x", "/etc/passwd"} {
+		m := &Manifest{Files: []ManifestFile{{Name: "l", Link: link}}}
+		if err := m.validatePaths(); !errors.Is(err, ErrLinkEscapes) {
+			t.Errorf("%v: expected ErrLinkEscapes, but got %v", link, err)
+		}
+	}
+	m := &Manifest{Files: []ManifestFile{{Name: "bin/l", Link: "../lib/x.so"}}}
+	if err := m.validatePaths(); err != nil {
+		t.Errorf("Expected link inside root to be valid, but got %v", err)
+	}
+}
+
+func TestLinksAndExecSurviveUpdate(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	release := path.Join(tmp, "release")
+	os.MkdirAll(path.Join(release, "lib/v1"), 0777)
+	ioutil.WriteFile(path.Join(release, "lib/v1/libx.so"), []byte("library"), 0644)
+	ioutil.WriteFile(path.Join(release, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+	os.Symlink("v1/libx.so", path.Join(release, "lib/libx.so"))
+	os.Symlink("lib/v1", path.Join(release, "current"))
+	writeTestRelease(t, release, nil)
+	u.Config.BinDir.Remote.Path = release
+
+	dir := &u.Config.BinDir
+	os.MkdirAll(dir.LocalPath, 0777)
+	ioutil.WriteFile(path.Join(dir.LocalPath, "stale.txt"), []byte("stale"), 0644)
+	ioutil.WriteFile(path.Join(dir.LocalPath, "site.log"), []byte("log"), 0644)
+	ioutil.WriteFile(path.Join(dir.LocalPath, IgnoreFilename), []byte("*.log\n"), 0644)
+
+	u.Download()
+	u.Apply()
+	if u.lastError != "" {
+		t.Fatal(u.lastError)
+	}
+	for _, root := range []string{dir.LocalPathNext, dir.LocalPath} {
+		if target, err := os.Readlink(path.Join(root, "lib/libx.so")); err != nil || target != "v1/libx.so" {
+			t.Errorf("%v: expected file symlink, but got %v %v", root, target, err)
+		}
+		if target, err := os.Readlink(path.Join(root, "current")); err != nil || target != "lib/v1" {
+			t.Errorf("%v: expected dir symlink, but got %v %v", root, target, err)
+		}
+		if info, err := os.Stat(path.Join(root, "run.sh")); err != nil || info.Mode()&0100 == 0 {
+			t.Errorf("%v: expected run.sh to be executable", root)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir.LocalPath, "stale.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected mirror to remove stale.txt")
+	}
+	if _, err := os.Stat(path.Join(dir.LocalPath, "site.log")); err != nil {
+		t.Errorf("Expected mirror to keep ignored file site.log")
+	}
+	if readHashFile(dir.LocalPath) != readHashFile(release) {
+		t.Errorf("Expected release to be installed")
+	}
+}
@@ -0,0 +1,8 @@
+package updater
+
+// Windows does not record the executable bit
+const execBitSupported = false
+
+func setExecBit(filename string, exec bool) error {
+	return nil
+}
@@ -0,0 +1,142 @@
+package updater
+
+// This deals with the persistent hash cache.
+//
+// Building the manifest of a large tree means reading and hashing gigabytes of data,
+// and we do that several times per update. The hash cache remembers the hash of every
+// file, together with its size, modification time and inode. If none of those have
+// changed, then we trust the cached hash. The cache lives beside the directory
+// (eg c:/imqsbin.hashcache), so that it is never part of a release.
+//
+// To guard against anything that slips past the size/time/inode check, the cache is
+// ignored, and every file is rehashed, once every Config.HashCacheRehashHours.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hashCacheExtension = ".hashcache"
+
+// Files modified this recently are not cached, because a second modification within the
+// resolution of the file system's timestamps would go unnoticed.
+const hashCacheMinAge = 2 * time.Second
+
+type hashCacheEntry struct {
+	Size    int64
+	ModTime int64 // Unix nanoseconds
+	Inode   uint64
+	Hash    string
+}
+
+type hashCache struct {
+	LastFullRehash time.Time
+	Entries        map[string]*hashCacheEntry // Key is the filename relative to the root of the dir
+
+	filename string
+	lock     sync.Mutex
+	rehash   bool            // Ignore all entries, because it's time for a full rehash
+	seen     map[string]bool // Entries that were looked up. All others are discarded on save.
+}
+
+// A function that builds the manifest of a directory
+type manifestBuilder func(rootDir string) (*Manifest, error)
+
+// Build the manifest of 'rootDir', using the hash cache if it is enabled
+func (u *Updater) buildManifest(rootDir string) (*Manifest, error) {
+	return u.buildManifestIgnoring(rootDir, nil)
+}
+
+// Like buildManifest, but leaves out the paths matched by 'ignore'
+func (u *Updater) buildManifestIgnoring(rootDir string, ignore *ignoreRules) (*Manifest, error) {
+	m := new(Manifest)
+	if err := m.scanPathRecursive(rootDir, "", compressedSiblings(rootDir), ignore); err != nil {
+		return nil, err
+	}
+	var cache *hashCache
+	if !u.Config.DisableHashCache {
+		cache = loadHashCache(rootDir, time.Duration(u.Config.HashCacheRehashHours*float64(time.Hour)))
+	}
+	if err := m.calculateHashes(rootDir, cache, u.Config.HashWorkers); err != nil {
+		return nil, err
+	}
+	if cache == nil {
+		return m, nil
+	}
+	if err := cache.save(); err != nil {
+		u.log.Warnf("Failed to save hash cache %v: %v", cache.filename, err)
+	}
+	return m, nil
+}
+
+// Load the cache of rootDir. If the cache is missing or corrupt, then an empty cache is returned.
+func loadHashCache(rootDir string, rehashInterval time.Duration) *hashCache {
+	c := &hashCache{
+		filename: strings.TrimRight(rootDir, "/\\") + hashCacheExtension,
+		Entries:  map[string]*hashCacheEntry{},
+		seen:     map[string]bool{},
+	}
+	if raw, err := ioutil.ReadFile(c.filename); err == nil {
+		if json.Unmarshal(raw, c) != nil || c.Entries == nil {
+			c.Entries = map[string]*hashCacheEntry{}
+		}
+	}
+	if rehashInterval > 0 && time.Now().Sub(c.LastFullRehash) > rehashInterval {
+		c.rehash = true
+		c.LastFullRehash = time.Now()
+	}
+	return c
+}
+
+// Returns the cached hash of the file, or an empty string if the file has changed since it was cached
+func (c *hashCache) lookup(relName string, info os.FileInfo) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seen[relName] = true
+	e := c.Entries[relName]
+	if c.rehash || e == nil {
+		return ""
+	}
+	if e.Size != info.Size() || e.ModTime != info.ModTime().UnixNano() || e.Inode != fileInode(info) {
+		return ""
+	}
+	return e.Hash
+}
+
+func (c *hashCache) store(relName string, info os.FileInfo, hash string) {
+	if time.Now().Sub(info.ModTime()) < hashCacheMinAge {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Entries[relName] = &hashCacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   fileInode(info),
+		Hash:    hash,
+	}
+}
+
+// Write the cache to disk, discarding entries for files that no longer exist
+func (c *hashCache) save() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name := range c.Entries {
+		if !c.seen[name] {
+			delete(c.Entries, name)
+		}
+	}
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, newFilePerms); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.filename)
+}
@@ -0,0 +1,68 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestHashCache(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	dir := path.Join(tmp, "dir")
+	os.MkdirAll(dir, 0777)
+	filename := path.Join(dir, "a.txt")
+	ioutil.WriteFile(filename, []byte("hello"), 0666)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filename, old, old)
+
+	m1, err := u.buildManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Poison the cache, to prove that it is used
+	cache := loadHashCache(dir, 0)
+	cache.Entries["a.txt"].Hash = "poisoned"
+	cache.seen["a.txt"] = true
+	cache.save()
+	if m2, _ := u.buildManifest(dir); m2.Files[0].Hash != "poisoned" {
+		t.Errorf("Expected cached hash to be used")
+	}
+
+	// A full rehash must ignore the cache
+	u.Config.HashCacheRehashHours = 0.0001
+	time.Sleep(time.Second)
+	if m3, _ := u.buildManifest(dir); m3.Files[0].Hash != m1.Files[0].Hash {
+		t.Errorf("Expected full rehash to ignore the cache")
+	}
+
+	// A modified file must be rehashed
+	u.Config.HashCacheRehashHours = 0
+	ioutil.WriteFile(filename, []byte("hello world"), 0666)
+	os.Chtimes(filename, old, old)
+	if m4, _ := u.buildManifest(dir); m4.Files[0].Hash == m1.Files[0].Hash {
+		t.Errorf("Expected modified file to be rehashed")
+	}
+}
+
+func TestParallelHashingIsDeterministic(t *testing.T) {
+	tmp := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 50; i++ {
+		files[path.Join("d", string(rune('a'+i%26)), string(rune('a'+i/26))+".txt")] = string(rune(i))
+	}
+	writeTestRelease(t, tmp, files)
+	expect, _ := ReadManifest(tmp)
+	for _, workers := range []int{1, 3, 16} {
+		m, _ := BuildManifestWithoutHashes(tmp)
+		if err := m.calculateHashes(tmp, nil, workers); err != nil {
+			t.Fatal(err)
+		}
+		if string(m.hash()) != string(expect.hash()) {
+			t.Errorf("Manifest hash changed with %v workers", workers)
+		}
+	}
+}
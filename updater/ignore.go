@@ -0,0 +1,273 @@
+package updater
+
+// This deals with local-only files inside synchronized directories.
+//
+// Sites keep caches, logs and per-site overrides inside directories such as c:/imqsvar/conf.
+// Without ignore rules, the mirror step would wipe those out, because they are not part of
+// the release. Ignore rules come from two places: SyncDir.Ignore in the config, and a
+// .updaterignore file in the root of LocalPath. Both use a subset of the .gitignore syntax:
+//
+//	# comment
+//	*.log          Any file or directory called *.log, at any depth
+//	cache/         Any directory called cache, at any depth
+//	/local.json    Only local.json in the root
+//	data/**/*.tmp  Any .tmp file anywhere below data
+//	!keep.log      Don't ignore keep.log, even though *.log is ignored
+//
+// Anything inside an ignored directory is also ignored. A path that is part of the
+// release is never ignored, because that would make the release impossible to install.
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+const IgnoreFilename = ".updaterignore"
+
+type ignoreRules struct {
+	patterns []*ignorePattern
+	keep     map[string]bool // Paths that are part of the release, and are therefore never ignored
+}
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	name    string // The pattern itself, if it only matches names (eg *.log), and so can be handed to robocopy as is
+}
+
+// Build the ignore rules of syncDir. 'release' is the manifest of the release that is being
+// installed, and may be nil.
+func (s *SyncDir) ignoreRules(release *Manifest) *ignoreRules {
+	r := &ignoreRules{
+		keep: map[string]bool{},
+	}
+	r.add("/" + IgnoreFilename)
+	for _, line := range s.Ignore {
+		r.add(line)
+	}
+	if raw, err := ioutil.ReadFile(path.Join(s.LocalPath, IgnoreFilename)); err == nil {
+		for _, line := range strings.Split(string(raw), "\n") {
+			r.add(line)
+		}
+	}
+	if release != nil {
+		for _, f := range release.Files {
+			r.keep[f.Name] = true
+		}
+		for _, d := range release.Dirs {
+			r.keep[d] = true
+		}
+	}
+	return r
+}
+
+func (r *ignoreRules) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	p := &ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A pattern with a slash in it is relative to the root. Otherwise it matches at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return
+	}
+	if !anchored && !strings.Contains(line, "**") && !strings.ContainsAny(line, "[\\") {
+		p.name = line
+	}
+
+	expr := ""
+	for i := 0; i < len(line); i++ {
+		switch {
+		case strings.HasPrefix(line[i:], "**/"):
+			expr += "(.*/)?"
+			i += 2
+		case strings.HasPrefix(line[i:], "**"):
+			expr += ".*"
+			i++
+		case line[i] == '*':
+			expr += "[^/]*"
+		case line[i] == '?':
+			expr += "[^/]"
+		default:
+			expr += regexp.QuoteMeta(line[i : i+1])
+		}
+	}
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "(^|/)" + expr + "$"
+	}
+	if runtime.GOOS == "windows" {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return
+	}
+	p.re = re
+	r.patterns = append(r.patterns, p)
+}
+
+// Returns true if relName (relative to the root of the dir, with forward slashes) must be left alone
+func (r *ignoreRules) isIgnored(relName string, isDir bool) bool {
+	if r == nil || r.keep[relName] {
+		return false
+	}
+	for i := 0; i < len(relName); i++ {
+		if relName[i] == '/' {
+			parent := relName[:i]
+			if !r.keep[parent] && r.matches(parent, true) {
+				return true
+			}
+		}
+	}
+	return r.matches(relName, isDir)
+}
+
+// The last matching pattern wins
+func (r *ignoreRules) matches(relName string, isDir bool) bool {
+	ignored := false
+	for _, p := range r.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(relName) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// Called when scanning found nothing inside the directory relName. Returns true if the directory is
+// not part of the release, and is not empty, which means that it holds only local-only files.
+func (r *ignoreRules) ownsDir(rootDir, relName string) bool {
+	if r == nil || r.keep[relName] {
+		return false
+	}
+	items, err := ioutil.ReadDir(path.Join(rootDir, relName))
+	return err == nil && len(items) != 0
+}
+
+// Returns the full paths of the ignored files and directories inside rootDir.
+// Directories are listed, but not their contents.
+func (r *ignoreRules) findIgnored(rootDir, relDir string) (files, dirs []string, err error) {
+	items, err := ioutil.ReadDir(path.Join(rootDir, relDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	for _, item := range items {
+		relName := path.Join(relDir, item.Name())
+		fullName := path.Join(rootDir, relName)
+		if r.isIgnored(relName, item.IsDir()) {
+			if item.IsDir() {
+				dirs = append(dirs, fullName)
+			} else {
+				files = append(files, fullName)
+			}
+		} else if item.IsDir() {
+			subFiles, subDirs, err := r.findIgnored(rootDir, relName)
+			if err != nil {
+				return nil, nil, err
+			}
+			files = append(files, subFiles...)
+			dirs = append(dirs, subDirs...)
+		}
+	}
+	return files, dirs, nil
+}
+
+// Returns what the mirror step must leave alone inside rootDir, in the form that shellMirrorDirectory takes.
+// Patterns that only match names (eg *.log or cache/) are passed on as they are, because listing every
+// matching path could exceed the 32K limit of a Windows command line. They can only be passed on if
+// there are no negated patterns, and if they match nothing in the release, because robocopy knows
+// about neither. Everything else is listed by full path, as found by findIgnored.
+func (r *ignoreRules) mirrorExcludes(rootDir string) (files, dirs []string, err error) {
+	names := r.namePatterns()
+	for _, p := range names {
+		if !p.dirOnly {
+			files = append(files, p.name)
+		}
+		dirs = append(dirs, p.name)
+	}
+	ignoredFiles, ignoredDirs, err := r.findIgnored(rootDir, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	matchesName := func(fullName string, isDir bool) bool {
+		for _, p := range names {
+			if (isDir || !p.dirOnly) && p.re.MatchString(path.Base(fullName)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, f := range ignoredFiles {
+		if !matchesName(f, false) {
+			files = append(files, f)
+		}
+	}
+	for _, d := range ignoredDirs {
+		if !matchesName(d, true) {
+			dirs = append(dirs, d)
+		}
+	}
+	return files, dirs, nil
+}
+
+// Returns the patterns that can be handed on as names. See mirrorExcludes.
+func (r *ignoreRules) namePatterns() []*ignorePattern {
+	if r == nil {
+		return nil
+	}
+	for _, p := range r.patterns {
+		if p.negate {
+			return nil
+		}
+	}
+	names := []*ignorePattern{}
+	for _, p := range r.patterns {
+		if p.name != "" && !p.matchesAny(r.keep) {
+			names = append(names, p)
+		}
+	}
+	return names
+}
+
+// Returns true if the pattern matches any of 'paths', or any of their parent directories
+func (p *ignorePattern) matchesAny(paths map[string]bool) bool {
+	for name := range paths {
+		for dir := name; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+			if p.re.MatchString(dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns a manifestBuilder that leaves out the local-only files of syncDir
+func (u *Updater) syncDirManifestBuilder(syncDir *SyncDir) manifestBuilder {
+	release, _ := ReadManifest(syncDir.LocalPathNext)
+	ignore := syncDir.ignoreRules(release)
+	return func(rootDir string) (*Manifest, error) {
+		return u.buildManifestIgnoring(rootDir, ignore)
+	}
+}
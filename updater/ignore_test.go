@@ -0,0 +1,114 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	s := &SyncDir{
+		LocalPath: t.TempDir(),
+		Ignore:    []string{"*.log", "cache/", "/local.json", "data/**/*.tmp", "!keep.log"},
+	}
+	release := &Manifest{Files: []ManifestFile{{Name: "bin/release.log"}}}
+	r := s.ignoreRules(release)
+	cases := []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"sub/b.log", false, true},
+		{"keep.log", false, false},
+		{"bin/release.log", false, false},
+		{"cache", true, true},
+		{"cache", false, false},
+		{"sub/cache/x.dat", false, true},
+		{"local.json", false, true},
+		{"sub/local.json", false, false},
+		{"data/x.tmp", false, true},
+		{"data/a/b/x.tmp", false, true},
+		{"other/x.tmp", false, false},
+		{IgnoreFilename, false, true},
+		{"app.exe", false, false},
+	}
+	for _, c := range cases {
+		if r.isIgnored(c.name, c.isDir) != c.ignored {
+			t.Errorf("isIgnored(%v, %v) should be %v", c.name, c.isDir, c.ignored)
+		}
+	}
+}
+
+func TestIgnoredFilesSurviveStaging(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{"a.txt": "hello"})
+	u.Config.BinDir.Remote.Path = release
+
+	dir := &u.Config.BinDir
+	writeTestRelease(t, dir.LocalPath, map[string]string{"old.txt": "old"})
+	ioutil.WriteFile(path.Join(dir.LocalPath, IgnoreFilename), []byte("*.log\ncache/\n"), 0666)
+	for _, root := range []string{dir.LocalPath, dir.LocalPathNext} {
+		os.MkdirAll(path.Join(root, "gone/cache"), 0777)
+		ioutil.WriteFile(path.Join(root, "site.log"), []byte("log"), 0666)
+		ioutil.WriteFile(path.Join(root, "gone/cache/c.dat"), []byte("cache"), 0666)
+	}
+
+	u.Download()
+	if u.lastError != "" {
+		t.Fatal(u.lastError)
+	}
+	for _, name := range []string{"site.log", "gone/cache/c.dat"} {
+		if _, err := os.Stat(path.Join(dir.LocalPathNext, name)); err != nil {
+			t.Errorf("Ignored file %v was deleted from LocalPathNext", name)
+		}
+	}
+	if ready, err := dir.isReadyToApply(u.syncDirManifestBuilder(dir)); err != nil || !ready {
+		t.Errorf("Expected ignored files not to affect readiness (%v, %v)", ready, err)
+	}
+
+	files, dirs, err := dir.ignoreRules(nil).findIgnored(dir.LocalPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || len(dirs) != 1 || dirs[0] != path.Join(dir.LocalPath, "gone/cache") {
+		t.Errorf("Unexpected mirror exclusions %v %v", files, dirs)
+	}
+}
+
+func TestMirrorExcludesUseNamePatterns(t *testing.T) {
+	s := &SyncDir{
+		LocalPath: t.TempDir(),
+		Ignore:    []string{"*.log", "cache/", "/local.json"},
+	}
+	for _, name := range []string{"a.log", "sub/b.log", "sub/deep/c.log", "local.json", "app.exe"} {
+		os.MkdirAll(path.Dir(path.Join(s.LocalPath, name)), 0777)
+		ioutil.WriteFile(path.Join(s.LocalPath, name), []byte("x"), 0666)
+	}
+	os.MkdirAll(path.Join(s.LocalPath, "sub/cache"), 0777)
+
+	release := &Manifest{Files: []ManifestFile{{Name: "app.exe"}}}
+	files, dirs, err := s.ignoreRules(release).mirrorExcludes(s.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0] != "*.log" || files[1] != path.Join(s.LocalPath, "local.json") {
+		t.Errorf("Expected *.log and the full path of local.json, but got %v", files)
+	}
+	if len(dirs) != 2 || dirs[0] != "*.log" || dirs[1] != "cache" {
+		t.Errorf("Expected *.log and cache, but got %v", dirs)
+	}
+
+	// A pattern that matches part of the release must be expanded into paths
+	release.Files = append(release.Files, ManifestFile{Name: "sub/release.log"})
+	files, _, err = s.ignoreRules(release).mirrorExcludes(s.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Errorf("Expected every ignored file to be listed, but got %v", files)
+	}
+}
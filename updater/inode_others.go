@@ -0,0 +1,16 @@
+// +build !windows
+
+package updater
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the inode of the file, or zero if it is unknown
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,11 @@
+package updater
+
+import (
+	"os"
+)
+
+// The file index is not part of the information that os.Stat gives us on Windows,
+// and fetching it costs an extra open per file, so we rely on size and modification time.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
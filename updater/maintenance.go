@@ -0,0 +1,189 @@
+package updater
+
+// This deals with maintenance windows, which are the times at which releases may be installed.
+//
+// Installing a release restarts services, so customers would rather that it happened after hours.
+// Downloads are not affected by the windows. A staged release simply waits for the next window.
+// A release that is built with "buildmanifest -urgent" is installed right away, regardless of
+// the windows. With no windows configured, releases are installed as soon as they are staged.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A weekly period in which releases may be installed
+type MaintenanceWindow struct {
+	Days     []string // ["Sat", "Sun"] (Days on which the window opens. Empty = every day)
+	Start    string   // 22:00 (When the window opens)
+	End      string   // 04:00 (When the window closes. If this is before Start, then the window closes on the next day. If it is equal, then the window is open all day.)
+	Timezone string   // Africa/Johannesburg (optional. Empty = the local time of the machine)
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// A MaintenanceWindow, parsed
+type maintenanceWindow struct {
+	days       map[time.Weekday]bool // nil = every day
+	start, end int                   // Minutes since midnight
+	loc        *time.Location
+}
+
+func (w *MaintenanceWindow) parse() (*maintenanceWindow, error) {
+	p := &maintenanceWindow{loc: time.Local}
+	var err error
+	if p.start, err = parseTimeOfDay(w.Start); err != nil {
+		return nil, err
+	}
+	if p.end, err = parseTimeOfDay(w.End); err != nil {
+		return nil, err
+	}
+	if w.Timezone != "" {
+		if p.loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return nil, fmt.Errorf("Invalid maintenance window timezone '%v': %v", w.Timezone, err)
+		}
+	}
+	if len(w.Days) != 0 {
+		p.days = map[time.Weekday]bool{}
+		for _, day := range w.Days {
+			name := strings.ToLower(strings.TrimSpace(day))
+			if len(name) > 3 {
+				name = name[:3]
+			}
+			wd, ok := weekdayNames[name]
+			if !ok {
+				return nil, fmt.Errorf("Invalid maintenance window day '%v'", day)
+			}
+			p.days[wd] = true
+		}
+	}
+	return p, nil
+}
+
+// Parse HH:MM into minutes since midnight
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid maintenance window time '%v'. Expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (p *maintenanceWindow) opensOn(day time.Weekday) bool {
+	return p.days == nil || p.days[day]
+}
+
+func (p *maintenanceWindow) isOpen(now time.Time) bool {
+	t := now.In(p.loc)
+	m := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	switch {
+	case p.start < p.end:
+		return p.opensOn(today) && m >= p.start && m < p.end
+	case p.start > p.end:
+		// The window runs past midnight, so it may have opened yesterday
+		return (p.opensOn(today) && m >= p.start) || (p.opensOn(yesterday) && m < p.end)
+	default:
+		return p.opensOn(today)
+	}
+}
+
+// Returns the first time after 'now' at which the window opens, or the zero time if it never does
+func (p *maintenanceWindow) nextOpening(now time.Time) time.Time {
+	t := now.In(p.loc)
+	start := p.start
+	if p.start == p.end {
+		// Open all day
+		start = 0
+	}
+	for i := 0; i <= 7; i++ {
+		opening := time.Date(t.Year(), t.Month(), t.Day()+i, start/60, start%60, 0, 0, p.loc)
+		if p.opensOn(opening.Weekday()) && opening.After(now) {
+			return opening
+		}
+	}
+	return time.Time{}
+}
+
+// Parse the windows, and keep the result for inMaintenanceWindow and nextMaintenanceWindow
+func (c *Config) validateMaintenanceWindows() error {
+	parsed := []*maintenanceWindow{}
+	for i := range c.MaintenanceWindows {
+		p, err := c.MaintenanceWindows[i].parse()
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, p)
+	}
+	c.maintenanceWindows = parsed
+	return nil
+}
+
+// Returns the parsed windows. If MaintenanceWindows has been changed since it was validated, then it is parsed again.
+func (c *Config) parsedMaintenanceWindows() []*maintenanceWindow {
+	if len(c.maintenanceWindows) == len(c.MaintenanceWindows) {
+		return c.maintenanceWindows
+	}
+	parsed := []*maintenanceWindow{}
+	for i := range c.MaintenanceWindows {
+		if p, err := c.MaintenanceWindows[i].parse(); err == nil {
+			parsed = append(parsed, p)
+		}
+	}
+	return parsed
+}
+
+// Returns true if releases may be installed at 'now'
+func (c *Config) inMaintenanceWindow(now time.Time) bool {
+	if len(c.MaintenanceWindows) == 0 {
+		return true
+	}
+	for _, p := range c.parsedMaintenanceWindows() {
+		if p.isOpen(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the next time after 'now' at which a maintenance window opens, or the zero time if there is none
+func (c *Config) nextMaintenanceWindow(now time.Time) time.Time {
+	next := time.Time{}
+	for _, p := range c.parsedMaintenanceWindows() {
+		if t := p.nextOpening(now); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// Split 'ready' into the dirs that can be applied at 'now', and the dirs that must wait for the next
+// maintenance window. Urgent releases never wait.
+func (u *Updater) holdBackForWindow(ready []*SyncDir, now time.Time) (apply []*SyncDir, held map[*SyncDir]string) {
+	held = map[*SyncDir]string{}
+	if u.Config.inMaintenanceWindow(now) {
+		return ready, held
+	}
+	reason := "Waiting for the next maintenance window"
+	if next := u.Config.nextMaintenanceWindow(now); !next.IsZero() {
+		reason += fmt.Sprintf(", at %v", next.Format("2006-01-02 15:04 MST"))
+	}
+	for _, dir := range ready {
+		if release, err := ReadManifest(dir.LocalPathNext); err == nil && release.Urgent {
+			apply = append(apply, dir)
+		} else {
+			held[dir] = reason
+		}
+	}
+	return apply, held
+}
@@ -0,0 +1,93 @@
+// +build !windows
+
+package updater
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	c := NewConfig()
+	c.MaintenanceWindows = []MaintenanceWindow{
+		{Days: []string{"Fri", "saturday"}, Start: "22:00", End: "04:00", Timezone: "Africa/Johannesburg"},
+		{Days: []string{"Sun"}, Start: "12:00", End: "12:30", Timezone: "UTC"},
+	}
+	if err := c.validateMaintenanceWindows(); err != nil {
+		t.Fatal(err)
+	}
+	sast := time.FixedZone("SAST", 2*60*60)
+	cases := []struct {
+		t    time.Time
+		open bool
+	}{
+		{time.Date(2026, 10, 16, 21, 59, 0, 0, sast), false}, // Friday
+		{time.Date(2026, 10, 16, 22, 0, 0, 0, sast), true},
+		{time.Date(2026, 10, 17, 3, 59, 0, 0, sast), true}, // Saturday morning, in Friday's window
+		{time.Date(2026, 10, 17, 4, 0, 0, 0, sast), false},
+		{time.Date(2026, 10, 18, 2, 0, 0, 0, sast), true}, // Sunday morning, in Saturday's window
+		{time.Date(2026, 10, 18, 12, 15, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 19, 2, 0, 0, 0, sast), false},      // Monday morning
+		{time.Date(2026, 10, 16, 20, 30, 0, 0, time.UTC), true}, // Friday 22:30 in SAST
+	}
+	for _, tc := range cases {
+		if open := c.inMaintenanceWindow(tc.t); open != tc.open {
+			t.Errorf("%v: expected open = %v", tc.t, tc.open)
+		}
+	}
+	next := c.nextMaintenanceWindow(time.Date(2026, 10, 19, 2, 0, 0, 0, sast))
+	if !next.Equal(time.Date(2026, 10, 23, 22, 0, 0, 0, sast)) {
+		t.Errorf("Unexpected next window %v", next)
+	}
+
+	for _, bad := range []MaintenanceWindow{{Start: "25:00", End: "01:00"}, {Start: "22:00"}, {Start: "22:00", End: "23:00", Days: []string{"Funday"}}, {Start: "22:00", End: "23:00", Timezone: "Nowhere/Town"}} {
+		c.MaintenanceWindows = []MaintenanceWindow{bad}
+		if err := c.validateMaintenanceWindows(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestApplyWaitsForMaintenanceWindow(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	dir := &u.Config.BinDir
+	// A window that is never open now
+	closed := time.Now().Add(-2 * time.Hour).Format("15:04")
+	u.Config.MaintenanceWindows = []MaintenanceWindow{{Start: closed, End: time.Now().Add(-time.Hour).Format("15:04")}}
+
+	dir.Remote.Path = path.Join(tmp, "release")
+	writeTestRelease(t, dir.Remote.Path, map[string]string{"a.txt": "one"})
+	u.Download()
+	u.Apply()
+	if readHashFile(dir.LocalPath) != "" {
+		t.Fatal("Expected the release to wait for the maintenance window")
+	}
+	if st := u.Status(); st.Dirs[0].ReadyToApply || st.Dirs[0].NotReadyReason == "" {
+		t.Errorf("Expected status to explain why the release is waiting, but got %+v", st.Dirs[0])
+	}
+	u.ApplyNow()
+	if readHashFile(dir.LocalPath) != readHashFile(dir.Remote.Path) {
+		t.Fatal("Expected ApplyNow to ignore the maintenance window")
+	}
+
+	// Urgent releases don't wait
+	writeTestRelease(t, dir.Remote.Path, map[string]string{"a.txt": "two"})
+	m, _ := ReadManifest(dir.Remote.Path)
+	plain := string(m.hash())
+	m.Urgent = true
+	if string(m.hash()) != plain || m.extHash() == "" {
+		t.Error("Urgent must be part of ExtHash, and not of the manifest hash, otherwise older updaters reject the release")
+	}
+	if err := m.Write(dir.Remote.Path); err != nil {
+		t.Fatal(err)
+	}
+	u.Download()
+	u.Apply()
+	if readHashFile(dir.LocalPath) != readHashFile(dir.Remote.Path) {
+		t.Fatal("Expected the urgent release to be installed outside of the maintenance window")
+	}
+}
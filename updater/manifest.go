@@ -10,27 +10,48 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
 )
 
 const ManifestFilename_Content = "manifest.content"
 const ManifestFilename_Hash = "manifest.hash"
 
 var ErrManifestInconsistent = errors.New("Manifest content and hash are inconsistent")
+var ErrContentInconsistent = errors.New("Files on disk are inconsistent with manifest")
 
 type ManifestFile struct {
-	Name string // Filename, relative to root
-	Hash string // hex-encoded SHA256 hash of file contents
+	Name   string          // Filename, relative to root
+	Hash   string          // hex-encoded SHA256 hash of file contents
+	Chunks []ManifestChunk `json:",omitempty"` // Content-defined chunks of large files (optional. Not part of the manifest hash)
+	Link   string          `json:",omitempty"` // If not empty, then this is a symlink to Link (relative, with forward slashes), and Hash is empty
+	Exec   bool            `json:",omitempty"` // The file is executable. Only unix file systems record this.
+	Size   int64           `json:",omitempty"` // Size in bytes (informational. Not part of the manifest hash, and missing from older manifests)
 }
 
 // Returns true if the file exists, and its hash is the same as Hash
 func (f *ManifestFile) hashEqualsDiskFile(rootDir string) bool {
-	body, err := ioutil.ReadFile(path.Join(rootDir, f.Name))
+	hash, err := hashFile(path.Join(rootDir, f.Name))
+	return err == nil && hash == f.Hash
+}
+
+// Returns the hex-encoded SHA256 hash of the file.
+// The file is streamed through the hash, so that we never hold a large file in memory.
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return false
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
-	hash := sha256.Sum256(body)
-	return hex.EncodeToString(hash[:]) == f.Hash
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // This stores enough information for a client to know when the contents of a file tree
@@ -38,16 +59,19 @@ func (f *ManifestFile) hashEqualsDiskFile(rootDir string) bool {
 // we avoid corner cases such as the deletion of a directory, and subsequent replacement
 // by a file of the same name.
 type Manifest struct {
-	Files []ManifestFile
-	Dirs  []string
+	Files    []ManifestFile
+	Dirs     []string
+	Requires map[string]string `json:",omitempty"` // Other releases that must be installed with this one. Remote path (eg imqsconf/stable) -> manifest hash. See coupling.go.
+	Urgent   bool              `json:",omitempty"` // Install this release right away, even outside of the maintenance windows
+	ExtHash  string            `json:",omitempty"` // hex-encoded SHA256 of the information that is not part of manifest.hash (see extHash)
 }
 
 func BuildManifest(rootDir string) (*Manifest, error) {
-	m := new(Manifest)
-	if err := m.scanPathRecursive(rootDir, ""); err != nil {
+	m, err := BuildManifestWithoutHashes(rootDir)
+	if err != nil {
 		return nil, err
 	}
-	if err := m.calculateHashes(rootDir); err != nil {
+	if err := m.calculateHashes(rootDir, nil, 0); err != nil {
 		return nil, err
 	}
 	return m, nil
@@ -55,7 +79,7 @@ func BuildManifest(rootDir string) (*Manifest, error) {
 
 func BuildManifestWithoutHashes(rootDir string) (*Manifest, error) {
 	m := new(Manifest)
-	if err := m.scanPathRecursive(rootDir, ""); err != nil {
+	if err := m.scanPathRecursive(rootDir, "", compressedSiblings(rootDir), nil); err != nil {
 		return nil, err
 	}
 	return m, nil
@@ -66,14 +90,49 @@ func ReadManifest(rootDir string) (*Manifest, error) {
 	if err != nil {
 		return nil, err
 	}
-	m := &Manifest{}
-	err = json.Unmarshal(body, m)
+	return parseManifest(body)
+}
+
+// Read a manifest from a stream, such as a download
+func readManifestFrom(r io.Reader) (*Manifest, error) {
+	body, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	return parseManifest(body)
+}
+
+func parseManifest(body []byte) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, err
+	}
+	if err := m.validatePaths(); err != nil {
+		return nil, err
+	}
+	if err := m.validateChunks(); err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
+// Before comparing a manifest built from disk with 'release', we take from 'release' the things that
+// the disk cannot tell us: the requirements and urgency of the release, and on file systems without an executable
+// bit (ie Windows), which files are executable.
+func (m *Manifest) adoptReleaseInfo(release *Manifest) {
+	m.Requires = release.Requires
+	m.Urgent = release.Urgent
+	if execBitSupported {
+		return
+	}
+	byName := release.nameToFileMap()
+	for i := range m.Files {
+		if r := byName[m.Files[i].Name]; r != nil {
+			m.Files[i].Exec = r.Exec
+		}
+	}
+}
+
 // Returns nil if the hash file and the manifest file in the given directory are consistent with each other
 func isManifestPairConsistent(rootDir string) error {
 	m, err := ReadManifest(rootDir)
@@ -93,13 +152,14 @@ func (m *Manifest) isConsistentWithHash(rootDir string) error {
 	if err != nil {
 		return err
 	}
-	if !bytes.Equal(m.hash(), hash) {
+	if !bytes.Equal(m.hash(), hash) || m.ExtHash != m.extHash() {
 		return ErrManifestInconsistent
 	}
 	return nil
 }
 
 func (m *Manifest) Write(rootDir string) error {
+	m.ExtHash = m.extHash()
 	if str, err := json.MarshalIndent(m, "", "\t"); err != nil {
 		return err
 	} else {
@@ -114,10 +174,13 @@ func (m *Manifest) Write(rootDir string) error {
 }
 
 // Return a map from hex-encoded hash to ManifestFile
-// If there are duplicate entries, then the last one wins
+// If there are duplicate entries, then the last one wins. Symlinks have no hash, so they are left out.
 func (m *Manifest) hashToFileMap() map[string]*ManifestFile {
 	res := map[string]*ManifestFile{}
 	for i := range m.Files {
+		if m.Files[i].Link != "" {
+			continue
+		}
 		res[m.Files[i].Hash] = &m.Files[i]
 	}
 	return res
@@ -158,27 +221,82 @@ func (m *Manifest) hash() []byte {
 	return h.Sum(nil)
 }
 
+// Links, executable files, Requires and Urgent were added to the manifest later. Older updaters only hash names and
+// file hashes, so if these were part of manifest.hash, then those updaters would reject every release
+// that has them, including the release that upgrades them. Instead, they are hashed separately, into
+// ExtHash, which is inside manifest.content. Returns an empty string if there is nothing to hash.
+func (m *Manifest) extHash() string {
+	h := sha256.New()
+	empty := true
+	for _, file := range m.Files {
+		if file.Link != "" {
+			io.WriteString(h, file.Name+"\x00link:"+file.Link+"\x00")
+			empty = false
+		}
+		if file.Exec {
+			io.WriteString(h, file.Name+"\x00exec\x00")
+			empty = false
+		}
+	}
+	remotePaths := []string{}
+	for remotePath := range m.Requires {
+		remotePaths = append(remotePaths, remotePath)
+	}
+	sort.Strings(remotePaths)
+	for _, remotePath := range remotePaths {
+		io.WriteString(h, "\x00requires:"+remotePath+"="+m.Requires[remotePath]+"\x00")
+		empty = false
+	}
+	if m.Urgent {
+		io.WriteString(h, "\x00urgent\x00")
+		empty = false
+	}
+	if empty {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // Adds the files to the manifest, but does not compute their hashes.
-// Use calculateHashes to populate the hashes
-func (m *Manifest) scanPathRecursive(rootDir, relDir string) error {
+// Use calculateHashes to populate the hashes.
+// Files inside 'skip' are not part of the release (eg compressed siblings).
+// Paths matched by 'ignore' (which may be nil) are local-only, and are left out too.
+func (m *Manifest) scanPathRecursive(rootDir, relDir string, skip map[string]bool, ignore *ignoreRules) error {
 	if items, err := ioutil.ReadDir(path.Join(rootDir, relDir)); err != nil {
 		return err
 	} else {
 		for _, item := range items {
 			relName := path.Join(relDir, item.Name())
-			if relName == ManifestFilename_Content || relName == ManifestFilename_Hash {
+			if relName == ManifestFilename_Content || relName == ManifestFilename_Hash || relName == ManifestFilename_Compressed || skip[relName] {
+				continue
+			}
+			if ignore.isIgnored(relName, item.IsDir()) {
 				continue
 			}
 
 			if item.IsDir() {
+				nDirs, nFiles := len(m.Dirs), len(m.Files)
 				m.Dirs = append(m.Dirs, relName)
-				if err := m.scanPathRecursive(rootDir, relName); err != nil {
+				if err := m.scanPathRecursive(rootDir, relName, skip, ignore); err != nil {
 					return err
 				}
+				if len(m.Dirs) == nDirs+1 && len(m.Files) == nFiles && ignore.ownsDir(rootDir, relName) {
+					m.Dirs = m.Dirs[:nDirs]
+				}
 			} else {
 				file := ManifestFile{
 					Name: relName,
 				}
+				if item.Mode()&os.ModeSymlink != 0 {
+					target, err := os.Readlink(path.Join(rootDir, relName))
+					if err != nil {
+						return err
+					}
+					file.Link = filepath.ToSlash(target)
+				} else {
+					file.Exec = item.Mode()&0100 != 0
+					file.Size = item.Size()
+				}
 				m.Files = append(m.Files, file)
 			}
 		}
@@ -186,14 +304,69 @@ func (m *Manifest) scanPathRecursive(rootDir, relDir string) error {
 	return nil
 }
 
-func (m *Manifest) calculateHashes(rootDir string) error {
+// Hash all files, using 'workers' goroutines (or one per CPU if workers is zero).
+// Every hash is written into its own slot in m.Files, so the order of the files never changes.
+// If cache is not nil, then it is used to avoid rehashing files that have not changed.
+func (m *Manifest) calculateHashes(rootDir string, cache *hashCache, workers int) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	jobs := make(chan int)
+	errs := make(chan error, 1)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := m.Files[i].calculateHash(rootDir, cache); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
 	for i := range m.Files {
-		if bytes, err := ioutil.ReadFile(path.Join(rootDir, m.Files[i].Name)); err != nil {
+		if len(errs) != 0 {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (f *ManifestFile) calculateHash(rootDir string, cache *hashCache) error {
+	if f.Link != "" {
+		return nil
+	}
+	filename := path.Join(rootDir, f.Name)
+	var info os.FileInfo
+	if cache != nil {
+		var err error
+		if info, err = os.Stat(filename); err != nil {
 			return err
-		} else {
-			hash := sha256.Sum256(bytes)
-			m.Files[i].Hash = hex.EncodeToString(hash[:])
 		}
+		if hash := cache.lookup(f.Name, info); hash != "" {
+			f.Hash = hash
+			return nil
+		}
+	}
+	hash, err := hashFile(filename)
+	if err != nil {
+		return err
+	}
+	f.Hash = hash
+	if cache != nil {
+		cache.store(f.Name, info, hash)
 	}
 	return nil
 }
@@ -0,0 +1,141 @@
+package updater
+
+// This deals with validating the paths inside a manifest.
+//
+// Every name in a manifest is joined onto LocalPathNext, and some of them are passed to
+// os.RemoveAll, so a tampered or buggy manifest could otherwise reach outside of the
+// synchronized directory. Names must be relative, use forward slashes, and be valid on
+// Windows as well as on unix, because the same release is installed on both.
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var ErrPathInvalid = errors.New("Path is empty, not clean, or contains a backslash or control character")
+var ErrPathTraversal = errors.New("Path contains '..'")
+var ErrPathAbsolute = errors.New("Path is absolute")
+var ErrPathDuplicate = errors.New("Path is listed more than once")
+var ErrPathCaseCollision = errors.New("Path differs from another path only by case")
+var ErrPathReserved = errors.New("Path contains a reserved name")
+var ErrPathFileDirCollision = errors.New("Path is both a file and a directory")
+var ErrLinkEscapes = errors.New("Symlink target is absolute, or outside of the directory")
+
+// A manifest entry with an unsafe path
+type ManifestPathError struct {
+	Name string
+	Err  error
+}
+
+func (e *ManifestPathError) Error() string {
+	return fmt.Sprintf("Invalid path in manifest '%v': %v", e.Name, e.Err)
+}
+
+func (e *ManifestPathError) Unwrap() error {
+	return e.Err
+}
+
+// Names that Windows treats as devices, with or without an extension
+var windowsReservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// Returns a *ManifestPathError if any of the files or directories in the manifest has an unsafe path
+func (m *Manifest) validatePaths() error {
+	files := map[string]bool{}
+	dirs := map[string]bool{}
+	folded := map[string]string{}
+	check := func(name string, isDir bool) error {
+		if err := validatePath(name); err != nil {
+			return &ManifestPathError{name, err}
+		}
+		if (isDir && files[name]) || (!isDir && dirs[name]) {
+			return &ManifestPathError{name, ErrPathFileDirCollision}
+		} else if files[name] || dirs[name] {
+			return &ManifestPathError{name, ErrPathDuplicate}
+		}
+		if other, exists := folded[strings.ToLower(name)]; exists {
+			return &ManifestPathError{name, fmt.Errorf("%w ('%v')", ErrPathCaseCollision, other)}
+		}
+		if isDir {
+			dirs[name] = true
+		} else {
+			files[name] = true
+		}
+		folded[strings.ToLower(name)] = name
+		return nil
+	}
+	for _, d := range m.Dirs {
+		if err := check(d, true); err != nil {
+			return err
+		}
+	}
+	for _, f := range m.Files {
+		if err := check(f.Name, false); err != nil {
+			return err
+		}
+		if f.Link != "" && !isLinkInside(f.Name, f.Link) {
+			return &ManifestPathError{f.Name, ErrLinkEscapes}
+		}
+	}
+	// A file cannot be the parent of another entry
+	for name := range folded {
+		for i := 0; i < len(name); i++ {
+			if name[i] == '/' && files[name[:i]] {
+				return &ManifestPathError{name[:i], ErrPathFileDirCollision}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns nil if 'name' is a safe, relative, forward-slash path
+func validatePath(name string) error {
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return ErrPathAbsolute
+	}
+	if name == "" || strings.ContainsAny(name, "\\:") {
+		return ErrPathInvalid
+	}
+	for _, c := range name {
+		if c < 32 {
+			return ErrPathInvalid
+		}
+	}
+	for _, part := range strings.Split(name, "/") {
+		switch {
+		case part == "..":
+			return ErrPathTraversal
+		case part == "" || part == ".":
+			return ErrPathInvalid
+		case strings.HasSuffix(part, ".") || strings.HasSuffix(part, " "):
+			// Windows silently strips these, so "a." and "a" would be the same file
+			return ErrPathInvalid
+		}
+		base := strings.ToLower(part)
+		if dot := strings.IndexByte(base, '.'); dot != -1 {
+			base = base[:dot]
+		}
+		if windowsReservedNames[base] {
+			return ErrPathReserved
+		}
+	}
+	switch strings.ToLower(name) {
+	case ManifestFilename_Content, ManifestFilename_Hash, ManifestFilename_Compressed:
+		return ErrPathReserved
+	}
+	return nil
+}
+
+// Returns true if a symlink at 'name', pointing to 'target', stays inside the root directory
+func isLinkInside(name, target string) bool {
+	if strings.HasPrefix(target, "/") || strings.ContainsAny(target, "\\:") {
+		return false
+	}
+	resolved := path.Join(path.Dir(name), target)
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
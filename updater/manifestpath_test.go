@@ -0,0 +1,52 @@
+package updater
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestManifestPathValidation(t *testing.T) {
+	cases := []struct {
+		files []string
+		dirs  []string
+		err   error
+	}{
+		{[]string{"a.txt", "bin/b.exe"}, []string{"bin"}, nil},
+		{[]string{"../evil.exe"}, nil, ErrPathTraversal},
+		{[]string{"bin/../../evil.exe"}, nil, ErrPathTraversal},
+		{nil, []string{".."}, ErrPathTraversal},
+		{[]string{"/etc/passwd"}, nil, ErrPathAbsolute},
+		{[]string{"c:/windows/evil.dll"}, nil, ErrPathAbsolute},
+		{[]string{"bin\\..\\..\\evil.exe"}, nil, ErrPathInvalid},
+		{[]string{"a//b"}, nil, ErrPathInvalid},
+		{[]string{""}, nil, ErrPathInvalid},
+		{[]string{"a.txt", "a.txt"}, nil, ErrPathDuplicate},
+		{[]string{"Readme.txt", "README.txt"}, nil, ErrPathCaseCollision},
+		{[]string{"bin/x"}, []string{"bin", "BIN"}, ErrPathCaseCollision},
+		{[]string{"aux.txt"}, nil, ErrPathReserved},
+		{[]string{"logs/COM1"}, nil, ErrPathReserved},
+		{[]string{"manifest.hash"}, nil, ErrPathReserved},
+		{[]string{"data"}, []string{"data"}, ErrPathFileDirCollision},
+		{[]string{"data", "data/x.txt"}, nil, ErrPathFileDirCollision},
+	}
+	for _, c := range cases {
+		m := &Manifest{Dirs: c.dirs}
+		for _, name := range c.files {
+			m.Files = append(m.Files, ManifestFile{Name: name})
+		}
+		err := m.validatePaths()
+		if !errors.Is(err, c.err) || (err == nil) != (c.err == nil) {
+			t.Errorf("%v %v: expected %v, but got %v", c.files, c.dirs, c.err, err)
+		}
+		var pathErr *ManifestPathError
+		if err != nil && !errors.As(err, &pathErr) {
+			t.Errorf("%v: expected a *ManifestPathError", err)
+		}
+	}
+}
+
+func TestParseManifestRejectsTraversal(t *testing.T) {
+	if _, err := parseManifest([]byte(`{"Files":[{"Name":"../../x","Hash":"00"}]}`)); !errors.Is(err, ErrPathTraversal) {
+		t.Errorf("Expected ErrPathTraversal, but got %v", err)
+	}
+}
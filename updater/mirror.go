@@ -0,0 +1,225 @@
+package updater
+
+// This deals with mirrors of the deploy server.
+//
+// Within one sync, manifest.hash and manifest.content always come from the same mirror,
+// because a mirror that is halfway through receiving a new release could otherwise give
+// us a hash from one release and a manifest from another. Individual files can come from
+// any mirror, because every file is checked against its hash in the manifest.
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A mirror of the deploy server
+type Mirror struct {
+	Url      string // https://deploy2.imqs.co.za/files
+	Priority int    // Mirrors with lower numbers are tried first
+}
+
+// Keeps track of which mirrors are failing, so that we can stop using them for a while
+type mirrorHealth struct {
+	lock  sync.Mutex
+	state map[string]*mirrorState
+}
+
+type mirrorState struct {
+	failures      int       // Consecutive failures
+	disabledUntil time.Time // Do not use this mirror until this time
+}
+
+func newMirrorHealth() *mirrorHealth {
+	return &mirrorHealth{
+		state: map[string]*mirrorState{},
+	}
+}
+
+func (h *mirrorHealth) get(url string) *mirrorState {
+	s := h.state[url]
+	if s == nil {
+		s = &mirrorState{}
+		h.state[url] = s
+	}
+	return s
+}
+
+func (h *mirrorHealth) isUsable(url string, now time.Time) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return !now.Before(h.get(url).disabledUntil)
+}
+
+func (h *mirrorHealth) succeeded(url string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.get(url).failures = 0
+}
+
+// Returns true if this failure caused the mirror to be taken out of use
+func (h *mirrorHealth) failed(url string, now time.Time, threshold int, cooldown time.Duration) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := h.get(url)
+	s.failures++
+	if s.failures >= threshold {
+		s.failures = 0
+		s.disabledUntil = now.Add(cooldown)
+		return true
+	}
+	return false
+}
+
+// Returns the mirrors that should be tried, in order of preference.
+// If every mirror is out of use, then we try all of them, because that's better than giving up.
+func (u *Updater) orderedMirrors() []Mirror {
+	all := append([]Mirror{}, u.Config.Mirrors...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Priority < all[j].Priority })
+	now := time.Now()
+	usable := []Mirror{}
+	for _, m := range all {
+		if u.mirrorHealth.isUsable(m.Url, now) {
+			usable = append(usable, m)
+		}
+	}
+	if len(usable) == 0 {
+		return all
+	}
+	return usable
+}
+
+// A Source that is spread over several mirrors
+type mirrorSource struct {
+	members []*mirrorMember
+	pinned  *mirrorMember // The mirror that gave us manifest.hash
+}
+
+// One mirror inside a mirrorSource. This records the health of the mirror on every request.
+type mirrorMember struct {
+	*httpSource
+	url string
+	u   *Updater
+}
+
+// A file that opens fine can still turn out to be corrupt, so for files other than the manifest,
+// success is only recorded once downloadFileVerified has checked the hash (see verified).
+func (m *mirrorMember) Open(name string) (io.ReadCloser, error) {
+	r, err := m.httpSource.Open(name)
+	if err != nil {
+		m.failed()
+		return nil, err
+	}
+	if name == ManifestFilename_Hash || name == ManifestFilename_Content {
+		m.u.mirrorHealth.succeeded(m.url)
+	}
+	return r, nil
+}
+
+func (m *mirrorMember) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	r, err := m.httpSource.OpenRange(name, offset, length)
+	if err != nil {
+		m.failed()
+		return nil, err
+	}
+	m.u.mirrorHealth.succeeded(m.url)
+	return r, nil
+}
+
+func (m *mirrorMember) verified(ok bool) {
+	if ok {
+		m.u.mirrorHealth.succeeded(m.url)
+	} else {
+		m.failed()
+	}
+}
+
+func (m *mirrorMember) failed() {
+	m.u.recordFailure("Mirror", m.url)
+}
+
+// Record a failure of the mirror or peer at 'url', and take it out of use if it keeps failing.
+// A failing mirror is not an error of the updater, as long as another source has the file, so this does not set lastError.
+func (u *Updater) recordFailure(what, url string) {
+	cooldown := time.Duration(u.Config.MirrorCooldownSeconds * float64(time.Second))
+	if u.mirrorHealth.failed(url, time.Now(), u.Config.MirrorFailureThreshold, cooldown) {
+		u.log.Warnf("%v %v is failing. Not using it for %v seconds", what, url, u.Config.MirrorCooldownSeconds)
+	}
+}
+
+func (u *Updater) newMirrorSource(remote RemotePath) *mirrorSource {
+	s := &mirrorSource{}
+	for _, m := range u.orderedMirrors() {
+		hs := newHttpSource(m.Url+"/"+remote.Path, remote, u.httpClient)
+		hs.conditional = u.conditional
+		s.members = append(s.members, &mirrorMember{
+			httpSource: hs,
+			url:        m.Url,
+			u:          u,
+		})
+	}
+	return s
+}
+
+func (s *mirrorSource) Describe(name string) string {
+	if s.pinned != nil {
+		return s.pinned.Describe(name)
+	}
+	return s.members[0].Describe(name)
+}
+
+func (s *mirrorSource) Open(name string) (io.ReadCloser, error) {
+	if name == ManifestFilename_Content && s.pinned != nil {
+		return s.pinned.Open(name)
+	}
+	var firstErr error
+	for _, m := range s.members {
+		r, err := m.Open(name)
+		if err == nil {
+			if name == ManifestFilename_Hash {
+				s.pinned = m
+			}
+			return r, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (s *mirrorSource) openUncompressed(name string) (io.ReadCloser, error) {
+	if s.pinned != nil {
+		return s.pinned.openUncompressed(name)
+	}
+	return s.members[0].openUncompressed(name)
+}
+
+func (s *mirrorSource) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	var firstErr error
+	for _, m := range s.alternatives(nil) {
+		r, err := m.(*mirrorMember).OpenRange(name, offset, length)
+		if err == nil {
+			return r, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// Returns all of the mirrors, with the pinned mirror first
+func (s *mirrorSource) alternatives(file *ManifestFile) []Source {
+	all := []Source{}
+	if s.pinned != nil {
+		all = append(all, s.pinned)
+	}
+	for _, m := range s.members {
+		if m != s.pinned {
+			all = append(all, m)
+		}
+	}
+	return all
+}
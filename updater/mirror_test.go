@@ -0,0 +1,77 @@
+package updater
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestMirrorFailover(t *testing.T) {
+	tmp := t.TempDir()
+	writeTestRelease(t, path.Join(tmp, "files/imqsbin/stable"), map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": "world",
+	})
+	good := httptest.NewServer(http.StripPrefix("/files/", http.FileServer(http.Dir(path.Join(tmp, "files")))))
+	defer good.Close()
+	badHits := 0
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits++
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	u := newTestUpdater(t, tmp)
+	u.Config.MirrorFailureThreshold = 1
+	u.Config.Mirrors = []Mirror{
+		{Url: good.URL + "/files", Priority: 2},
+		{Url: bad.URL + "/files", Priority: 1},
+	}
+	u.Download()
+	if ready, err := u.Config.BinDir.isReadyToApply(u.buildManifest); err != nil || !ready {
+		t.Fatalf("Expected download via the good mirror to be ready to apply (%v, %v)", ready, err)
+	}
+	if badHits != 1 {
+		t.Errorf("Expected the bad mirror to be tried once, but it was tried %v times", badHits)
+	}
+	if mirrors := u.orderedMirrors(); len(mirrors) != 1 || mirrors[0].Url != good.URL+"/files" {
+		t.Errorf("Expected the bad mirror to be out of use, but mirrors are %v", mirrors)
+	}
+}
+
+func TestMirrorServingCorruptFilesIsTakenOutOfUse(t *testing.T) {
+	tmp := t.TempDir()
+	writeTestRelease(t, path.Join(tmp, "files/imqsbin/stable"), map[string]string{
+		"a.txt": "hello",
+		"b.txt": "world",
+	})
+	files := http.StripPrefix("/files/", http.FileServer(http.Dir(path.Join(tmp, "files"))))
+	good := httptest.NewServer(files)
+	defer good.Close()
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) == ManifestFilename_Hash || path.Base(r.URL.Path) == ManifestFilename_Content {
+			files.ServeHTTP(w, r)
+			return
+		}
+		w.Write([]byte("garbage"))
+	}))
+	defer corrupt.Close()
+
+	u := newTestUpdater(t, tmp)
+	u.Config.MirrorFailureThreshold = 2
+	u.Config.Mirrors = []Mirror{
+		{Url: good.URL + "/files", Priority: 2},
+		{Url: corrupt.URL + "/files", Priority: 1},
+	}
+	u.Download()
+	if ready, err := u.Config.BinDir.isReadyToApply(u.buildManifest); err != nil || !ready {
+		t.Fatalf("Expected download via the good mirror to be ready to apply (%v, %v)", ready, err)
+	}
+	if mirrors := u.orderedMirrors(); len(mirrors) != 1 || mirrors[0].Url != good.URL+"/files" {
+		t.Errorf("Expected the corrupt mirror to be out of use, but mirrors are %v", mirrors)
+	}
+	if msg := u.getLastError(); msg != "" {
+		t.Errorf("Expected a failing mirror not to be reported as an error, but got %v", msg)
+	}
+}
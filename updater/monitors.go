@@ -5,6 +5,7 @@ package updater
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os/exec"
 	"path"
@@ -36,22 +37,75 @@ to that rogue service that is never stopped.
 By using the 'next' service names also, we allow an update to be pushed out
 which would provide the new service name, thereby unbricking the server.
 */
-func imqsServiceNames(upd *Updater) []string {
-	oldNames, _ := readLines(path.Join(upd.Config.BinDir.LocalPath, "servicenames"))
-	newNames, _ := readLines(path.Join(upd.Config.BinDir.LocalPathNext, "servicenames"))
-	for _, nNew := range newNames {
+func imqsServiceNames(upd *Updater, dirs []*SyncDir) []string {
+	return serviceNamesOf(upd.Config, dirs, func(s *SyncDir) string { return s.LocalPathNext })
+}
+
+// Returns the services that must be stopped while 'dirs' are installed. These are the services that each
+// dir lists itself, and those of the dirs named in its ServicesFrom. nextDir returns the directory that
+// holds the release that will be installed (normally LocalPathNext).
+func serviceNamesOf(c *Config, dirs []*SyncDir, nextDir func(s *SyncDir) string) []string {
+	names := []string{}
+	visited := map[*SyncDir]bool{}
+	var visit func(s *SyncDir)
+	visit = func(s *SyncDir) {
+		if s == nil || visited[s] {
+			return
+		}
+		visited[s] = true
+		names = mergeServiceNames(names, s.Services)
+		if s.ServiceListFile != "" {
+			names = mergeServiceNames(names, serviceNamesIn(s.LocalPath, nextDir(s), s.ServiceListFile))
+		}
+		for _, other := range s.ServicesFrom {
+			visit(c.syncDirByName(other))
+		}
+	}
+	for _, s := range dirs {
+		visit(s)
+	}
+	return names
+}
+
+// Returns the service names listed in listFile, in the current and the next release
+func serviceNamesIn(currentDir, nextDir, listFile string) []string {
+	oldNames, _ := readLines(path.Join(currentDir, listFile))
+	newNames, _ := readLines(path.Join(nextDir, listFile))
+	return mergeServiceNames(mergeServiceNames(nil, oldNames), newNames)
+}
+
+// Append the names in 'more' that are not yet in 'names'
+func mergeServiceNames(names, more []string) []string {
+	for _, nNew := range more {
 		exists := false
-		for _, nOld := range oldNames {
+		for _, nOld := range names {
 			if nOld == nNew {
 				exists = true
 				break
 			}
 		}
-		if !exists {
-			oldNames = append(oldNames, nNew)
+		// Blank lines (such as the one after a trailing newline) are not services
+		if !exists && nNew != "" {
+			names = append(names, nNew)
 		}
 	}
-	return oldNames
+	return names
+}
+
+// Run the command 'hook' of syncDir (ie BeforeApply or AfterApply), in LocalPath
+func runHook(upd *Updater, syncDir *SyncDir, which string, hook []string) error {
+	if len(hook) == 0 {
+		return nil
+	}
+	upd.log.Infof("Running %v hook of %v (%v)", which, syncDir, strings.Join(hook, " "))
+	cmd := exec.Command(hook[0], hook[1:]...)
+	cmd.Dir = syncDir.LocalPath
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		upd.log.Errorf("Output of %v hook of %v: %v", which, syncDir, string(out))
+		return fmt.Errorf("%v hook of %v failed: %v", which, syncDir, err)
+	}
+	return nil
 }
 
 func stopService(name string) {
@@ -87,7 +141,7 @@ func isServiceRunning(name string) bool {
 }
 
 func beforeSyncImqs(upd *Updater, updatedDirs []*SyncDir) error {
-	services := imqsServiceNames(upd)
+	services := imqsServiceNames(upd, updatedDirs)
 	upd.log.Infof("Stopping services (%v)", strings.Join(services, ", "))
 	for _, s := range services {
 		stopService(s)
@@ -113,14 +167,33 @@ func beforeSyncImqs(upd *Updater, updatedDirs []*SyncDir) error {
 		}
 		time.Sleep(1 * time.Second)
 	}
+	for _, dir := range updatedDirs {
+		if err := runHook(upd, dir, "BeforeApply", dir.BeforeApply); err != nil {
+			upd.log.Errorf("Abandoning update: %v", err)
+			for _, s := range services {
+				startService(s)
+			}
+			return err
+		}
+	}
 	return nil
 }
 
-func afterSyncImqs(upd *Updater, updatedDirs []*SyncDir) {
+// 'applied' is false if the dirs were restored to what they were before, in which case the AfterApply
+// hooks have nothing to do, but the services must still be started again
+func afterSyncImqs(upd *Updater, updatedDirs []*SyncDir, applied bool) {
 
 	// TODO: run install.rb
 
-	services := imqsServiceNames(upd)
+	if applied {
+		for _, dir := range updatedDirs {
+			if err := runHook(upd, dir, "AfterApply", dir.AfterApply); err != nil {
+				upd.warnf("%v", err)
+			}
+		}
+	}
+
+	services := imqsServiceNames(upd, updatedDirs)
 	upd.log.Infof("Starting services (%v)", strings.Join(services, ", "))
 	for _, s := range services {
 		startService(s)
@@ -0,0 +1,261 @@
+package updater
+
+// This deals with LAN peers. Customer sites often have several servers behind the same slow link.
+// One updater can serve the content of its synchronized directories to the others, by hash,
+// so that every release only crosses the slow link once.
+//
+// A peer is only ever trusted as far as the manifest: every file that we get from a peer
+// is checked against the hash in the manifest that we downloaded from our real source.
+//
+// Peers bypass the credentials of each SyncDir's Remote, so a dir is only served if its
+// ServeToPeers is set, and only to updaters that send Config.PeerSecret.
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const peerHashPrefix = "/hash/"
+const peerSecretHeader = "X-Updater-Peer-Secret"
+
+var ErrPeerSecretMissing = errors.New("PeerSecret is needed when PeerListen or Peers is set")
+
+// Returns an HTTP handler that serves the files of the SyncDirs that have ServeToPeers set, by hash, at /hash/<hex hash>
+func (u *Updater) peerHandler() http.Handler {
+	index := &peerIndex{
+		dirs:     map[string]*peerIndexDir{},
+		verified: map[string]*hashCacheEntry{},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := u.Config.PeerSecret
+		if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(peerSecretHeader)), []byte(secret)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		hash := strings.TrimPrefix(r.URL.Path, peerHashPrefix)
+		if r.Method != "GET" || !strings.HasPrefix(r.URL.Path, peerHashPrefix) || !isHexHash(hash) {
+			http.NotFound(w, r)
+			return
+		}
+		for _, dir := range u.Config.allSyncDirs() {
+			if !dir.ServeToPeers {
+				continue
+			}
+			for _, root := range []string{dir.LocalPath, dir.LocalPathNext} {
+				filename := index.find(root, hash)
+				// Don't serve a file that has been modified since its manifest was written
+				if filename == "" || !index.isIntact(filename, hash) {
+					continue
+				}
+				u.log.Debugf("Serving %v to peer %v", filename, r.RemoteAddr)
+				http.ServeFile(w, r, filename)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
+
+func (c *Config) validatePeers() error {
+	if (c.PeerListen != "" || len(c.Peers) != 0) && c.PeerSecret == "" {
+		return ErrPeerSecretMissing
+	}
+	return nil
+}
+
+// Serve peers forever. Does nothing if Config.PeerListen is empty.
+func (u *Updater) servePeers() {
+	if u.Config.PeerListen == "" {
+		return
+	}
+	if u.Config.PeerSecret == "" {
+		u.log.Errorf("Not serving peers: %v", ErrPeerSecretMissing)
+		return
+	}
+	u.log.Infof("Serving peers on %v", u.Config.PeerListen)
+	if err := http.ListenAndServe(u.Config.PeerListen, u.peerHandler()); err != nil {
+		u.log.Errorf("Peer server failed: %v", err)
+	}
+}
+
+// A cache of the manifests of our directories, so that we don't need to read
+// the manifest on every request.
+type peerIndex struct {
+	lock     sync.Mutex
+	dirs     map[string]*peerIndexDir
+	verified map[string]*hashCacheEntry // Files that we have checked against their hash. Key is the full path.
+}
+
+type peerIndexDir struct {
+	manifestHash string
+	files        map[string]*ManifestFile
+}
+
+// Returns the full path of a file inside rootDir with the given hash, or an empty string
+func (p *peerIndex) find(rootDir, hash string) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	manifestHash := readHashFile(rootDir)
+	if manifestHash == "" {
+		return ""
+	}
+	d := p.dirs[rootDir]
+	if d == nil || d.manifestHash != manifestHash {
+		m, err := ReadManifest(rootDir)
+		if err != nil || m.isConsistentWithHash(rootDir) != nil {
+			return ""
+		}
+		d = &peerIndexDir{
+			manifestHash: manifestHash,
+			files:        m.hashToFileMap(),
+		}
+		p.dirs[rootDir] = d
+	}
+	if f := d.files[hash]; f != nil {
+		return path.Join(rootDir, f.Name)
+	}
+	return ""
+}
+
+// Returns true if filename still has the given hash. The outcome is remembered until the size, modification
+// time or inode of the file changes, in the same way as the hash cache, so that we don't rehash a large file
+// for every peer that asks for it.
+func (p *peerIndex) isIntact(filename, hash string) bool {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	p.lock.Lock()
+	e := p.verified[filename]
+	p.lock.Unlock()
+	if e != nil && e.Hash == hash && e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() && e.Inode == fileInode(info) {
+		return true
+	}
+	if actual, err := hashFile(filename); err != nil || actual != hash {
+		return false
+	}
+	if time.Now().Sub(info.ModTime()) >= hashCacheMinAge {
+		p.lock.Lock()
+		p.verified[filename] = &hashCacheEntry{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			Inode:   fileInode(info),
+			Hash:    hash,
+		}
+		p.lock.Unlock()
+	}
+	return true
+}
+
+func isHexHash(s string) bool {
+	raw, err := hex.DecodeString(s)
+	return err == nil && len(raw) == 32
+}
+
+// A Source which tries our LAN peers before falling back to the real source.
+// Peers that keep failing are taken out of use for a while, in the same way as mirrors.
+type peeredSource struct {
+	Source
+	peers  []string
+	client *http.Client
+	u      *Updater
+}
+
+// The HTTP client for talking to peers. A peer that is switched off must not hold us up for long.
+func newPeerClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+	}
+}
+
+func (s *peeredSource) alternatives(file *ManifestFile) []Source {
+	all := []Source{}
+	now := time.Now()
+	for _, peer := range s.peers {
+		if !s.u.mirrorHealth.isUsable(peer, now) {
+			continue
+		}
+		all = append(all, &peerFileSource{
+			client: s.client,
+			url:    strings.TrimRight(peer, "/") + peerHashPrefix + file.Hash,
+			secret: s.u.Config.PeerSecret,
+			peer:   peer,
+			u:      s.u,
+		})
+	}
+	if ms, ok := s.Source.(multiSource); ok {
+		return append(all, ms.alternatives(file)...)
+	}
+	return append(all, s.Source)
+}
+
+// manifest.content is always read from the real source, so this is too
+func (s *peeredSource) openUncompressed(name string) (io.ReadCloser, error) {
+	if cs, ok := s.Source.(compressedSource); ok {
+		return cs.openUncompressed(name)
+	}
+	return s.Source.Open(name)
+}
+
+// Chunks are always read from the real source, because peers only serve whole files
+func (s *peeredSource) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	if rs, ok := s.Source.(rangeSource); ok {
+		return rs.OpenRange(name, offset, length)
+	}
+	return nil, ErrRangeNotSupported
+}
+
+// A single file on a peer. The name of the file is irrelevant, because peers serve files by hash.
+type peerFileSource struct {
+	client *http.Client
+	url    string
+	secret string // Config.PeerSecret
+	peer   string
+	u      *Updater
+}
+
+func (s *peerFileSource) Describe(name string) string {
+	return s.url
+}
+
+func (s *peerFileSource) Open(name string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerSecretHeader, s.secret)
+	res, err := s.client.Do(req)
+	if err != nil {
+		s.verified(false)
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		// Not having the file is normal, but anything else means that the peer is in trouble
+		if res.StatusCode != http.StatusNotFound {
+			s.verified(false)
+		}
+		return nil, os.ErrNotExist
+	}
+	return res.Body, nil
+}
+
+func (s *peerFileSource) verified(ok bool) {
+	if ok {
+		s.u.mirrorHealth.succeeded(s.peer)
+	} else {
+		s.u.recordFailure("Peer", s.peer)
+	}
+}
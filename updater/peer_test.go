@@ -0,0 +1,128 @@
+package updater
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDownloadFromPeer(t *testing.T) {
+	files := map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": "world",
+	}
+
+	// The peer already has the release
+	tmpPeer := t.TempDir()
+	peer := newTestUpdater(t, tmpPeer)
+	peer.Config.PeerSecret = "sesame"
+	peer.Config.BinDir.ServeToPeers = true
+	writeTestRelease(t, peer.Config.BinDir.LocalPath, files)
+	server := httptest.NewServer(peer.peerHandler())
+	defer server.Close()
+
+	// Our source only has the manifest, so the files can only come from the peer
+	tmp := t.TempDir()
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, files)
+	for name := range files {
+		os.Remove(path.Join(release, name))
+	}
+	u := newTestUpdater(t, tmp)
+	u.Config.BinDir.Remote.Path = release
+	u.Config.Peers = []string{server.URL}
+	u.Config.PeerSecret = "sesame"
+	u.Download()
+	if ready, err := u.Config.BinDir.isReadyToApply(u.buildManifest); err != nil || !ready {
+		t.Errorf("Expected download from peer to be ready to apply (%v, %v)", ready, err)
+	}
+}
+
+func TestFailingPeerIsTakenOutOfUse(t *testing.T) {
+	files := map[string]string{
+		"a.txt": "hello",
+		"b.txt": "world",
+	}
+	peerHits := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerHits++
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer peer.Close()
+
+	tmp := t.TempDir()
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, files)
+	u := newTestUpdater(t, tmp)
+	u.Config.BinDir.Remote.Path = release
+	u.Config.Peers = []string{peer.URL}
+	u.Config.MirrorFailureThreshold = 1
+	u.Download()
+	if ready, err := u.Config.BinDir.isReadyToApply(u.buildManifest); err != nil || !ready {
+		t.Fatalf("Expected download from the real source to be ready to apply (%v, %v)", ready, err)
+	}
+	if peerHits != 1 {
+		t.Errorf("Expected the failing peer to be tried once, but it was tried %v times", peerHits)
+	}
+}
+
+func TestPeerServingNeedsSecretAndOptIn(t *testing.T) {
+	tmp := t.TempDir()
+	peer := newTestUpdater(t, tmp)
+	peer.Config.PeerSecret = "sesame"
+	writeTestRelease(t, peer.Config.BinDir.LocalPath, map[string]string{"a.txt": "hello"})
+	m, err := ReadManifest(peer.Config.BinDir.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(peer.peerHandler())
+	defer server.Close()
+
+	get := func(secret string) int {
+		req, _ := http.NewRequest("GET", server.URL+peerHashPrefix+m.Files[0].Hash, nil)
+		if secret != "" {
+			req.Header.Set(peerSecretHeader, secret)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := get("sesame"); code != http.StatusNotFound {
+		t.Errorf("Expected a dir without ServeToPeers not to be served, but got %v", code)
+	}
+	peer.Config.BinDir.ServeToPeers = true
+	for _, secret := range []string{"", "wrong"} {
+		if code := get(secret); code != http.StatusUnauthorized {
+			t.Errorf("Expected secret '%v' to be refused, but got %v", secret, code)
+		}
+	}
+	if code := get("sesame"); code != http.StatusOK {
+		t.Errorf("Expected the file to be served, but got %v", code)
+	}
+
+	// A file that has changed since its manifest was written is no longer served
+	if err := ioutil.WriteFile(path.Join(peer.Config.BinDir.LocalPath, "a.txt"), []byte("changed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("sesame"); code != http.StatusNotFound {
+		t.Errorf("Expected a modified file not to be served, but got %v", code)
+	}
+}
+
+func TestPeersNeedSecret(t *testing.T) {
+	c := NewConfig()
+	c.Peers = []string{"http://imqs-app1:2016"}
+	if err := c.validatePeers(); err != ErrPeerSecretMissing {
+		t.Errorf("Expected ErrPeerSecretMissing, but got %v", err)
+	}
+	c.PeerSecret = "sesame"
+	if err := c.validatePeers(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,261 @@
+package updater
+
+// This deals with working out what an update will do, before doing it.
+//
+// Staging happens in two steps. planStaging compares the release with what is on disk,
+// and decides what to do with every file, without changing anything. executeStaging then
+// carries out the plan. "updater-cmd plan" runs only the first step, against a copy of the
+// remote manifest that is fetched into a scratch directory.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// What it takes to turn LocalPathNext into an image of a release. Names are relative to the root of the dir.
+type StagingPlan struct {
+	Download      []string      // Files that must be fetched from the remote
+	Copy          []StagingCopy // Files that are copied from LocalPath
+	Links         []string      // Symlinks that must be created
+	Unchanged     []string      // Files and links that are already in place
+	Delete        []string      // Files in LocalPathNext that are not part of the release
+	DeleteDirs    []string      // Directories in LocalPathNext that are not part of the release
+	CreateDirs    []string      // Directories of the release that are missing from LocalPathNext
+	DownloadBytes int64         // Size of the files in Download. Manifests that do not record sizes count as zero.
+	CopyBytes     int64         // Size of the files in Copy
+}
+
+// A file that is copied from LocalPath to LocalPathNext
+type StagingCopy struct {
+	From string
+	To   string
+}
+
+// What an update would do to one SyncDir
+type DirPlan struct {
+	Name        string
+	LocalPath   string
+	RemotePath  string
+	CurrentHash string
+	StagedHash  string
+	RemoteHash  string
+	UpToDate    bool         // The remote release is already installed
+	Staging     *StagingPlan `json:",omitempty"`
+	Error       string       `json:",omitempty"`
+}
+
+// What an update would do
+type Plan struct {
+	Dirs     []*DirPlan
+	Services []string // Services that would be stopped while the update is applied
+}
+
+// Work out what it takes to stage 'ideal_manifest_next' into LocalPathNext.
+// This reads, but never changes, LocalPath and LocalPathNext.
+func (u *Updater) planStaging(syncDir *SyncDir, ideal_manifest_next *Manifest) (*StagingPlan, error) {
+	// Local-only files are invisible to everything below, so they are never deleted
+	ignore := syncDir.ignoreRules(ideal_manifest_next)
+	// Do not attempt to use an old manifest file. Always build the manifest of our old contents from the content itself.
+	actual_manifest_prev, err := u.buildManifestIfExists(syncDir.LocalPath, ignore)
+	if err != nil {
+		return nil, err
+	}
+	actual_manifest_next, err := u.buildManifestIfExists(syncDir.LocalPathNext, ignore)
+	if err != nil {
+		return nil, err
+	}
+	plan := &StagingPlan{}
+
+	// Delete files not present in 'next' manifest
+	nameToFile := ideal_manifest_next.nameToFileMap()
+	for _, file := range actual_manifest_next.Files {
+		if nameToFile[file.Name] == nil {
+			plan.Delete = append(plan.Delete, file.Name)
+		}
+	}
+
+	// Delete directories not present in 'next' manifest
+	nameToDir := ideal_manifest_next.nameToDirMap()
+	for _, dir := range actual_manifest_next.Dirs {
+		if !nameToDir[dir] {
+			if ignoredFiles, ignoredDirs, _ := ignore.findIgnored(syncDir.LocalPathNext, dir); len(ignoredFiles)+len(ignoredDirs) != 0 {
+				u.log.Debugf("Keeping directory %v, because it contains ignored files", path.Join(syncDir.LocalPathNext, dir))
+				continue
+			}
+			plan.DeleteDirs = append(plan.DeleteDirs, dir)
+		}
+	}
+
+	// Create directories in 'next' manifest
+	actual_nameToDirNext := actual_manifest_next.nameToDirMap()
+	for _, dir := range ideal_manifest_next.Dirs {
+		if !actual_nameToDirNext[dir] {
+			plan.CreateDirs = append(plan.CreateDirs, dir)
+		}
+	}
+
+	// Retrieve (via copy or download) files in 'next' manifest
+	actual_hashToFilePrev := actual_manifest_prev.hashToFileMap()
+	actual_hashToFileNext := actual_manifest_next.hashToFileMap()
+	actual_nameToFileNext := actual_manifest_next.nameToFileMap()
+	for _, file := range ideal_manifest_next.Files {
+		if file.Link != "" {
+			if existing := actual_nameToFileNext[file.Name]; existing != nil && existing.Link == file.Link {
+				plan.Unchanged = append(plan.Unchanged, file.Name)
+			} else {
+				plan.Links = append(plan.Links, file.Name)
+			}
+			continue
+		}
+		outFile := path.Join(syncDir.LocalPathNext, file.Name)
+		actual_prev := actual_hashToFilePrev[file.Hash]
+		actual_next := actual_hashToFileNext[file.Hash]
+		if actual_prev != nil {
+			prevFullPath := path.Join(syncDir.LocalPath, actual_prev.Name)
+			if areFileDatesAndSizesEqual(prevFullPath, outFile) {
+				u.log.Debugf("%v satisfied by %v", outFile, prevFullPath)
+				plan.Unchanged = append(plan.Unchanged, file.Name)
+			} else {
+				plan.Copy = append(plan.Copy, StagingCopy{From: actual_prev.Name, To: file.Name})
+				plan.CopyBytes += file.Size
+			}
+		} else if actual_next != nil && actual_next.Name == file.Name {
+			u.log.Debugf("%v already downloaded", file.Name)
+			plan.Unchanged = append(plan.Unchanged, file.Name)
+		} else {
+			plan.Download = append(plan.Download, file.Name)
+			plan.DownloadBytes += file.Size
+		}
+	}
+	return plan, nil
+}
+
+// Like buildManifestIgnoring, but a directory that does not exist yet is treated as empty
+func (u *Updater) buildManifestIfExists(rootDir string, ignore *ignoreRules) (*Manifest, error) {
+	if _, err := os.Stat(rootDir); os.IsNotExist(err) {
+		return &Manifest{}, nil
+	}
+	return u.buildManifestIgnoring(rootDir, ignore)
+}
+
+// Work out what an update would do, without changing LocalPath or LocalPathNext.
+// The remote manifests are fetched into a temporary directory, which is removed afterwards.
+func (u *Updater) Plan() (*Plan, error) {
+	scratch, err := ioutil.TempDir("", "updater-plan")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratch)
+
+	p := &Plan{}
+	dirScratch := map[*SyncDir]string{}
+	changed := []*SyncDir{}
+	for i, dir := range u.Config.allSyncDirs() {
+		dirScratch[dir] = path.Join(scratch, strconv.Itoa(i))
+		dp := u.planDir(dir, dirScratch[dir])
+		p.Dirs = append(p.Dirs, dp)
+		if !dp.UpToDate && dp.Error == "" {
+			changed = append(changed, dir)
+		}
+	}
+	p.Services = serviceNamesOf(u.Config, changed, func(s *SyncDir) string { return dirScratch[s] })
+	return p, nil
+}
+
+func (u *Updater) planDir(syncDir *SyncDir, scratch string) *DirPlan {
+	dp := &DirPlan{
+		Name:        syncDir.Name,
+		LocalPath:   syncDir.LocalPath,
+		RemotePath:  syncDir.Remote.Path,
+		CurrentHash: readHashFile(syncDir.LocalPath),
+		StagedHash:  readHashFile(syncDir.LocalPathNext),
+	}
+	if err := u.planDirInto(dp, syncDir, scratch); err != nil {
+		dp.Error = err.Error()
+	}
+	return dp
+}
+
+func (u *Updater) planDirInto(dp *DirPlan, syncDir *SyncDir, scratch string) error {
+	if err := os.MkdirAll(scratch, newDirPerms|os.ModeDir); err != nil {
+		return err
+	}
+	src, err := u.source(syncDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{ManifestFilename_Hash, ManifestFilename_Content} {
+		if err := downloadFile(src, name, path.Join(scratch, name)); err != nil {
+			return err
+		}
+	}
+	if err := isManifestPairConsistent(scratch); err != nil {
+		return err
+	}
+	ideal, err := ReadManifest(scratch)
+	if err != nil {
+		return err
+	}
+	dp.RemoteHash = readHashFile(scratch)
+	dp.UpToDate = dp.RemoteHash == dp.CurrentHash
+	if dp.UpToDate {
+		return nil
+	}
+	if dp.Staging, err = u.planStaging(syncDir, ideal); err != nil {
+		return err
+	}
+	// The services that are stopped depend on the service list of the new release
+	if f := ideal.nameToFileMap()[syncDir.ServiceListFile]; f != nil {
+		if err := downloadFileVerified(src, f, path.Join(scratch, syncDir.ServiceListFile)); err != nil {
+			u.log.Warnf("Failed to fetch %v of the new release: %v", syncDir.ServiceListFile, err)
+		}
+	}
+	return nil
+}
+
+func (p *Plan) WriteText(w io.Writer) {
+	for _, dp := range p.Dirs {
+		fmt.Fprintf(w, "%v: %v (from %v)\n", dp.Name, dp.LocalPath, dp.RemotePath)
+		fmt.Fprintf(w, "  current %v\n  staged  %v\n  remote  %v\n", describeHash(dp.CurrentHash), describeHash(dp.StagedHash), describeHash(dp.RemoteHash))
+		switch {
+		case dp.Error != "":
+			fmt.Fprintf(w, "  error: %v\n", dp.Error)
+		case dp.UpToDate:
+			fmt.Fprintf(w, "  up to date\n")
+		default:
+			s := dp.Staging
+			for _, name := range s.Download {
+				fmt.Fprintf(w, "  download %v\n", name)
+			}
+			for _, c := range s.Copy {
+				fmt.Fprintf(w, "  copy     %v -> %v\n", c.From, c.To)
+			}
+			for _, name := range s.Links {
+				fmt.Fprintf(w, "  link     %v\n", name)
+			}
+			for _, name := range s.Delete {
+				fmt.Fprintf(w, "  delete   %v\n", name)
+			}
+			for _, dir := range s.DeleteDirs {
+				fmt.Fprintf(w, "  delete   %v/\n", dir)
+			}
+			fmt.Fprintf(w, "  %v files to download (%v bytes), %v to copy (%v bytes), %v to delete, %v unchanged\n",
+				len(s.Download), s.DownloadBytes, len(s.Copy), s.CopyBytes, len(s.Delete)+len(s.DeleteDirs), len(s.Unchanged))
+		}
+	}
+	if len(p.Services) != 0 {
+		fmt.Fprintf(w, "Services to stop: %v\n", strings.Join(p.Services, ", "))
+	}
+}
+
+func describeHash(hash string) string {
+	if hash == "" {
+		return "(none)"
+	}
+	return hash
+}
@@ -0,0 +1,76 @@
+package updater
+
+import (
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPlanDoesNotTouchLocalDirs(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	dir := &u.Config.BinDir
+	writeTestRelease(t, dir.LocalPath, map[string]string{
+		"keep.txt":     "keep",
+		"old.txt":      "old",
+		"servicenames": "ImqsAuth\n",
+	})
+	writeTestRelease(t, dir.LocalPathNext, map[string]string{
+		"keep.txt":     "keep",
+		"old.txt":      "old",
+		"servicenames": "ImqsAuth\n",
+	})
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{
+		"keep.txt":     "keep",
+		"new.txt":      "new content",
+		"servicenames": "ImqsAuth\nImqsMaps\n",
+	})
+	dir.Remote.Path = release
+	before := listTree(t, dir.LocalPath) + listTree(t, dir.LocalPathNext)
+
+	plan, err := u.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after := listTree(t, dir.LocalPath) + listTree(t, dir.LocalPathNext); after != before {
+		t.Errorf("Plan changed the local directories:\n%v\n%v", before, after)
+	}
+
+	dp := plan.Dirs[0]
+	if dp.Error != "" || dp.UpToDate || dp.RemoteHash != readHashFile(release) {
+		t.Fatalf("Unexpected plan %+v", dp)
+	}
+	s := dp.Staging
+	sort.Strings(s.Download)
+	if strings.Join(s.Download, ",") != "new.txt,servicenames" || s.DownloadBytes != int64(len("new content")+len("ImqsAuth\nImqsMaps\n")) {
+		t.Errorf("Unexpected downloads %v (%v bytes)", s.Download, s.DownloadBytes)
+	}
+	if strings.Join(s.Delete, ",") != "old.txt" || len(s.Copy)+len(s.Unchanged) != 1 {
+		t.Errorf("Unexpected deletes %v, or copies %v", s.Delete, s.Copy)
+	}
+	if strings.Join(plan.Services, ",") != "ImqsAuth,ImqsMaps" {
+		t.Errorf("Unexpected services %v", plan.Services)
+	}
+}
+
+// Returns the name, size and modification time of everything inside rootDir
+func listTree(t *testing.T, rootDir string) string {
+	items, err := ioutil.ReadDir(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := ""
+	for _, item := range items {
+		res += item.Name() + " " + item.ModTime().String() + "\n"
+		if item.IsDir() {
+			res += listTree(t, path.Join(rootDir, item.Name()))
+		} else if strings.HasPrefix(item.Name(), "manifest.") {
+			raw, _ := ioutil.ReadFile(path.Join(rootDir, item.Name()))
+			res += string(raw) + "\n"
+		}
+	}
+	return res
+}
@@ -0,0 +1,443 @@
+package updater
+
+// This deals with S3-compatible object storage, such as AWS S3 or MinIO.
+// Requests are signed with AWS Signature Version 4, and always use path-style URLs
+// (eg https://endpoint/bucket/key), because that is what every S3 clone understands.
+//
+// S3 has no way of swapping out a whole release at once, so every release is published under
+// its own prefix, named after its manifest hash (eg imqsbin/stable/9f86d0.../bin/imqs.exe).
+// The only object that is ever overwritten is manifest.hash, at the top of the prefix, which
+// tells clients which release to read. A client that is busy with the previous release keeps
+// reading the previous prefix, which we never modify. Old releases are not deleted by us,
+// so a lifecycle rule on the bucket should take care of them.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hash of an empty payload, which is what we sign for GET requests
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Uploads are streamed, so we do not sign their payload
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Connection details for S3-compatible storage
+type S3Config struct {
+	Endpoint        string // https://s3.af-south-1.amazonaws.com, or http://minio.local:9000
+	Region          string // af-south-1
+	AccessKeyID     string // Can be overridden per SyncDir by RemotePath.Username
+	SecretAccessKey string // Can be overridden per SyncDir by RemotePath.Password
+}
+
+type s3Client struct {
+	client    *http.Client
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	bucket    string
+	now       func() time.Time // Overridden by tests
+}
+
+// Parse s3://bucket/prefix into bucket and prefix
+func parseS3Url(s3Url string) (bucket, prefix string, err error) {
+	if !strings.HasPrefix(s3Url, "s3://") {
+		return "", "", fmt.Errorf("Not an s3:// URL: %v", s3Url)
+	}
+	p := strings.Trim(strings.TrimPrefix(s3Url, "s3://"), "/")
+	if i := strings.Index(p, "/"); i != -1 {
+		return p[:i], p[i+1:], nil
+	}
+	if p == "" {
+		return "", "", fmt.Errorf("No bucket in %v", s3Url)
+	}
+	return p, "", nil
+}
+
+func newS3Client(cfg S3Config, bucket, username, password string, client *http.Client) *s3Client {
+	c := &s3Client{
+		client:    client,
+		endpoint:  strings.TrimRight(cfg.Endpoint, "/"),
+		region:    cfg.Region,
+		accessKey: cfg.AccessKeyID,
+		secretKey: cfg.SecretAccessKey,
+		bucket:    bucket,
+		now:       time.Now,
+	}
+	if username != "" {
+		c.accessKey = username
+		c.secretKey = password
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	return c
+}
+
+func (c *s3Client) objectPath(key string) string {
+	return "/" + s3UriEncode(c.bucket, false) + "/" + s3UriEncode(key, false)
+}
+
+func (c *s3Client) newRequest(method, key string, body io.Reader) (*http.Request, error) {
+	rawPath := c.objectPath(key)
+	req, err := http.NewRequest(method, c.endpoint+rawPath, body)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure that the path we send is exactly the path that we sign
+	req.URL.RawPath = rawPath
+	return req, nil
+}
+
+// If length is zero, then the whole object is read
+func (c *s3Client) get(key string, offset, length int64) (io.ReadCloser, error) {
+	req, err := c.newRequest("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	expectStatus := http.StatusOK
+	if length != 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, offset+length-1))
+		expectStatus = http.StatusPartialContent
+	}
+	c.sign(req, s3EmptyPayloadHash)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != expectStatus {
+		res.Body.Close()
+		return nil, errors.New("Error reading s3://" + c.bucket + "/" + key + ": " + res.Status)
+	}
+	return res.Body, nil
+}
+
+// Upload 'size' bytes from 'body' to 'key'
+func (c *s3Client) put(key string, body io.Reader, size int64) error {
+	if size == 0 {
+		body = nil
+	}
+	req, err := c.newRequest("PUT", key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	c.sign(req, s3UnsignedPayload)
+	return c.do(req, key)
+}
+
+// Copy the object at 'from' to 'key', without it passing through us
+func (c *s3Client) copy(from, key string) error {
+	req, err := c.newRequest("PUT", key, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-amz-copy-source", c.objectPath(from))
+	c.sign(req, s3EmptyPayloadHash)
+	return c.do(req, key)
+}
+
+func (c *s3Client) do(req *http.Request, key string) error {
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	// A copy can fail after S3 has already sent 200 OK, in which case the body holds the error
+	if res.StatusCode != http.StatusOK || bytes.Contains(msg, []byte("<Error>")) {
+		return errors.New("Error writing s3://" + c.bucket + "/" + key + ": " + res.Status + " " + string(msg))
+	}
+	return nil
+}
+
+// Add AWS Signature Version 4 headers to req.
+// We sign the host, the Range header, and all x-amz-* headers.
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// URI encode according to the rules of AWS Signature Version 4
+func s3UriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// A Source inside an S3 bucket.
+// manifest.hash is read from the top of the prefix, and everything else from the prefix of that release.
+type s3Source struct {
+	client     *s3Client
+	prefix     string
+	lock       sync.Mutex
+	release    string          // Hash of the release that we are reading. Empty until we have read manifest.hash.
+	compressed map[string]bool // Files of 'release' that have compressed siblings
+}
+
+func newS3Source(cfg S3Config, remote RemotePath, client *http.Client) (*s3Source, error) {
+	bucket, prefix, err := parseS3Url(remote.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Source{
+		client: newS3Client(cfg, bucket, remote.Username, remote.Password, client),
+		prefix: prefix,
+	}, nil
+}
+
+func (s *s3Source) key(name string) string {
+	if name == ManifestFilename_Hash {
+		return path.Join(s.prefix, name)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return path.Join(s.prefix, s.release, name)
+}
+
+func (s *s3Source) Describe(name string) string {
+	return "s3://" + s.client.bucket + "/" + s.key(name)
+}
+
+// Read manifest.hash, and from then on read the files of the release that it names
+func (s *s3Source) readReleaseHash() (string, error) {
+	r, err := s.client.get(path.Join(s.prefix, ManifestFilename_Hash), 0, 0)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	hash := strings.TrimSpace(string(raw))
+	if !isHexHash(hash) {
+		return "", fmt.Errorf("Invalid hash in %v", s.Describe(ManifestFilename_Hash))
+	}
+	compressed := map[string]bool{}
+	if r, err := s.client.get(path.Join(s.prefix, hash, ManifestFilename_Compressed), 0, 0); err == nil {
+		raw, _ := ioutil.ReadAll(r)
+		r.Close()
+		for name := range ParseCompressedList(raw) {
+			compressed[name] = true
+		}
+	}
+	s.lock.Lock()
+	s.release = hash
+	s.compressed = compressed
+	s.lock.Unlock()
+	return string(raw), nil
+}
+
+// If we have not read manifest.hash yet, then read it now, so that we know which release to read from
+func (s *s3Source) ensureRelease() error {
+	s.lock.Lock()
+	known := s.release != ""
+	s.lock.Unlock()
+	if known {
+		return nil
+	}
+	_, err := s.readReleaseHash()
+	return err
+}
+
+func (s *s3Source) Open(name string) (io.ReadCloser, error) {
+	if name == ManifestFilename_Hash {
+		raw, err := s.readReleaseHash()
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(strings.NewReader(raw)), nil
+	}
+	if err := s.ensureRelease(); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	isCompressed := s.compressed[name]
+	s.lock.Unlock()
+	if isCompressed {
+		for _, e := range contentEncodings {
+			if r, err := s.client.get(s.key(name+e.extension), 0, 0); err == nil {
+				return decodeStream(e, r)
+			}
+		}
+	}
+	return s.client.get(s.key(name), 0, 0)
+}
+
+func (s *s3Source) openUncompressed(name string) (io.ReadCloser, error) {
+	if err := s.ensureRelease(); err != nil {
+		return nil, err
+	}
+	return s.client.get(s.key(name), 0, 0)
+}
+
+func (s *s3Source) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	if err := s.ensureRelease(); err != nil {
+		return nil, err
+	}
+	return s.client.get(s.key(name), offset, length)
+}
+
+/*
+Upload the release inside rootDir to s3://bucket/prefix.
+
+The release is uploaded under prefix/<hash>/, and only once all of it is in place, do we overwrite
+prefix/manifest.hash. A client therefore never sees a hash whose content is not fully uploaded,
+and a client that is still downloading the previous release is not disturbed, because nothing
+under the previous release's prefix changes. Files whose hash has not changed since the previous
+release are copied from its prefix inside S3, instead of being uploaded again. Compressed siblings
+(see WriteCompressedSiblings) are published too.
+*/
+func PublishS3(rootDir string, cfg S3Config, s3Url string, client *http.Client) error {
+	manifest, err := verifyReleaseDir(rootDir)
+	if err != nil {
+		return err
+	}
+	bucket, prefix, err := parseS3Url(s3Url)
+	if err != nil {
+		return err
+	}
+	c := newS3Client(cfg, bucket, "", "", client)
+	hash := readHashFile(rootDir)
+	releasePrefix := path.Join(prefix, hash)
+
+	// Figure out what the previous release was. If anything goes wrong here, just upload everything.
+	prev := &s3Source{client: c, prefix: prefix}
+	prevHash := ""
+	published := map[string]string{}
+	if raw, err := prev.readReleaseHash(); err == nil {
+		prevHash = strings.TrimSpace(raw)
+		if r, err := prev.Open(ManifestFilename_Content); err == nil {
+			if prevManifest, err := readManifestFrom(r); err == nil {
+				for _, f := range prevManifest.Files {
+					published[f.Name] = f.Hash
+				}
+			}
+			r.Close()
+		}
+	}
+
+	if prevHash != hash {
+		siblings := compressedSiblings(rootDir)
+		withSiblings := func(name string) []string {
+			names := []string{name}
+			for _, e := range contentEncodings {
+				if siblings[name+e.extension] {
+					names = append(names, name+e.extension)
+				}
+			}
+			return names
+		}
+		for _, f := range manifest.Files {
+			// S3 has no symlinks, but clients create them from the manifest
+			if f.Link != "" {
+				continue
+			}
+			for _, name := range withSiblings(f.Name) {
+				// The previous release may have had no sibling, or a sibling in another encoding, in which case the copy fails
+				copied := false
+				if published[f.Name] == f.Hash && (name == f.Name || prev.compressed[f.Name]) {
+					copied = c.copy(path.Join(prefix, prevHash, name), path.Join(releasePrefix, name)) == nil
+				}
+				if !copied {
+					if err := putFile(c, path.Join(releasePrefix, name), path.Join(rootDir, name)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		names := withSiblings(ManifestFilename_Content)
+		if _, err := os.Stat(path.Join(rootDir, ManifestFilename_Compressed)); err == nil {
+			names = append(names, ManifestFilename_Compressed)
+		}
+		for _, name := range names {
+			if err := putFile(c, path.Join(releasePrefix, name), path.Join(rootDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	// The hash must always be last
+	return putFile(c, path.Join(prefix, ManifestFilename_Hash), path.Join(rootDir, ManifestFilename_Hash))
+}
+
+func putFile(c *s3Client, key, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return c.put(key, f, info.Size())
+}
@@ -0,0 +1,221 @@
+package updater
+
+// This decides when each SyncDir is checked for updates.
+//
+// Every SyncDir is checked by its own goroutine, so that a large dir that is checked nightly
+// does not hold up a small dir that is checked every few minutes. A dir is checked either
+// every CheckIntervalSeconds, or according to Schedule, which is a cron expression with the
+// five fields minute, hour, day of month, month and day of week (eg "30 2 * * *" for 02:30 every
+// night, or "*/10 6-18 * * 1-5" for every 10 minutes during working hours). Fields may be *, a
+// number, a range (a-b), a step (*/n or a-b/n), or a comma separated list of those. Day of week
+// is 0 to 6, with Sunday as 0 (7 is also Sunday). As with cron, if both day of month and day of
+// week are restricted, then a day matching either of them will do. A field that starts with *
+// (eg */2) does not count as restricted for this, so "0 0 */2 * 1" means Mondays with an odd date.
+// JitterSeconds (or Config.CheckJitterSeconds) adds a random delay to every check, so that many
+// machines with the same schedule do not all hit the server at the same moment. For the same reason,
+// the first check waits for a random time of up to Config.StartupDelaySeconds. If the server answers
+// with 429 or 503 and a Retry-After header, then we wait at least that long before checking again.
+//
+// Downloads of different dirs run at the same time, but applies never overlap, because they
+// stop services. A dir that is busy downloading is not applied, and vice versa.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cronSchedule struct {
+	minute, hour, dom, month, dow []bool
+	domStar, dowStar              bool // The field starts with *, so the day must match both fields, rather than either
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid schedule '%v'. Expected 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+	c := &cronSchedule{}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	c.dow[0] = c.dow[0] || c.dow[7]
+	c.domStar = strings.HasPrefix(fields[2], "*")
+	c.dowStar = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// Returns a slice indexed by value, which is true for the values that the field matches
+func parseCronField(field string, min, max int) ([]bool, error) {
+	match := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if slash := strings.Index(part, "/"); slash != -1 {
+			rng = part[:slash]
+			s, err := strconv.Atoi(part[slash+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("Invalid step in schedule field '%v'", field)
+			}
+			step = s
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			if dash := strings.Index(rng, "-"); dash != -1 {
+				lo, err = strconv.Atoi(rng[:dash])
+				if err == nil {
+					hi, err = strconv.Atoi(rng[dash+1:])
+				}
+			} else {
+				lo, err = strconv.Atoi(rng)
+				hi = lo
+				if step != 1 {
+					hi = max
+				}
+			}
+			if err != nil || lo < min || hi > max || lo > hi {
+				return nil, fmt.Errorf("Invalid schedule field '%v'. Values must be from %v to %v", field, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			match[v] = true
+		}
+	}
+	return match, nil
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Returns the first time after 't' that matches the schedule, or the zero time if there is none
+// within the next five years (eg for "0 0 31 2 *").
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Returns the time at which syncDir must next be checked, if it was last checked at 'now'
+func (c *Config) nextCheck(syncDir *SyncDir, now time.Time) time.Time {
+	next := now.Add(c.checkInterval(syncDir))
+	if syncDir.Schedule != "" {
+		// The schedule was validated when the config was loaded
+		if cron, err := parseCron(syncDir.Schedule); err == nil {
+			if t := cron.next(now); !t.IsZero() {
+				next = t
+			}
+		}
+	}
+	jitter := syncDir.JitterSeconds
+	if jitter <= 0 {
+		jitter = c.CheckJitterSeconds
+	}
+	return next.Add(randomDuration(jitter))
+}
+
+// Returns a random duration of up to 'seconds'
+func randomDuration(seconds float64) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Float64() * seconds * float64(time.Second))
+}
+
+// Like nextCheck, but if the server asked us to back off (see RetryAfterError), then we wait at least as long as it asked
+func (u *Updater) nextCheckAfter(syncDir *SyncDir, fetchErr error, now time.Time) time.Time {
+	next := u.Config.nextCheck(syncDir, now)
+	var ra *RetryAfterError
+	if errors.As(fetchErr, &ra) && now.Add(ra.After).After(next) {
+		next = now.Add(ra.After).Add(randomDuration(u.Config.CheckJitterSeconds))
+		u.log.Infof("Server asked us to back off. Checking %v again at %v", syncDir, next.Format("15:04:05"))
+	}
+	return next
+}
+
+// Check syncDir on its schedule, forever
+func (u *Updater) runSyncDir(syncDir *SyncDir) {
+	for {
+		var err error
+		if !u.readState().Paused {
+			err = u.fetch(syncDir)
+			u.Apply()
+		}
+		time.Sleep(time.Until(u.nextCheckAfter(syncDir, err, time.Now())))
+	}
+}
+
+// Mark syncDir as busy (ie downloading or being applied). Returns false if it was already busy.
+// The claim is also taken in a lock file beside LocalPathNext, so that updater-cmd (eg a rollback) and
+// the service keep away from each other's dirs.
+func (u *Updater) claimDir(syncDir *SyncDir) bool {
+	u.busyLock.Lock()
+	defer u.busyLock.Unlock()
+	if u.busyDirs[syncDir] != nil {
+		return false
+	}
+	unlock, err := tryLockFile(dirLockFile(syncDir))
+	if err == errLockHeld {
+		return false
+	} else if err != nil {
+		u.log.Warnf("Unable to lock %v against other processes: %v", syncDir.LocalPath, err)
+		unlock = func() {}
+	}
+	u.busyDirs[syncDir] = unlock
+	return true
+}
+
+func dirLockFile(syncDir *SyncDir) string {
+	return strings.TrimRight(syncDir.LocalPathNext, "/\\") + ".lock"
+}
+
+// Wait until syncDir is no longer busy, and then claim it
+func (u *Updater) waitAndClaimDir(syncDir *SyncDir) {
+	for !u.claimDir(syncDir) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (u *Updater) releaseDir(syncDir *SyncDir) {
+	u.busyLock.Lock()
+	defer u.busyLock.Unlock()
+	if unlock := u.busyDirs[syncDir]; unlock != nil {
+		unlock()
+	}
+	delete(u.busyDirs, syncDir)
+}
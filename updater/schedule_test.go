@@ -0,0 +1,108 @@
+// +build !windows
+
+package updater
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// 2026-10-17 is a Saturday
+	from := time.Date(2026, 10, 17, 10, 7, 30, 0, time.UTC)
+	cases := []struct {
+		expr   string
+		expect time.Time
+	}{
+		{"30 2 * * *", time.Date(2026, 10, 18, 2, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 17, 10, 15, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"5,10 3 1 1 *", time.Date(2027, 1, 1, 3, 5, 0, 0, time.UTC)},
+		{"7 10 * * *", time.Date(2026, 10, 18, 10, 7, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+		// A day field that starts with * is not a restriction, so both day fields must match
+		{"0 0 */2 * 0", time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * */2", time.Date(2026, 12, 13, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		cron, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%v: %v", c.expr, err)
+		}
+		if next := cron.next(from); !next.Equal(c.expect) {
+			t.Errorf("%v: expected %v, but got %v", c.expr, c.expect, next)
+		}
+	}
+	for _, bad := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "* * 0 * *"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("Expected '%v' to be rejected", bad)
+		}
+	}
+}
+
+func TestNextCheck(t *testing.T) {
+	c := NewConfig()
+	now := time.Date(2026, 10, 17, 10, 7, 0, 0, time.UTC)
+	dir := &SyncDir{CheckIntervalSeconds: 60, JitterSeconds: 30}
+	for i := 0; i < 20; i++ {
+		next := c.nextCheck(dir, now)
+		if next.Before(now.Add(60*time.Second)) || next.After(now.Add(90*time.Second)) {
+			t.Fatalf("Next check %v is outside of interval plus jitter", next)
+		}
+	}
+	// Without its own jitter, a dir gets Config.CheckJitterSeconds
+	dir = &SyncDir{Schedule: "0 3 * * *"}
+	scheduled := time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)
+	if next := c.nextCheck(dir, now); next.Before(scheduled) || next.After(scheduled.Add(30*time.Second)) {
+		t.Errorf("Expected the schedule to decide the next check, but got %v", next)
+	}
+}
+
+func TestAppliesNeverOverlap(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	running, overlaps := int32(0), int32(0)
+	u.beforeSync = func(upd *Updater, updatedDirs []*SyncDir) error {
+		if atomic.AddInt32(&running, 1) != 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	u.afterSync = func(upd *Updater, updatedDirs []*SyncDir, applied bool) {
+		atomic.AddInt32(&running, -1)
+	}
+	bin := &u.Config.BinDir
+	conf := &u.Config.ConfDir
+	conf.LocalPath = path.Join(tmp, "conf")
+	conf.LocalPathNext = path.Join(tmp, "conf_next")
+
+	for _, release := range []string{"one", "two", "three"} {
+		bin.Remote.Path = path.Join(tmp, "release", release, "bin")
+		conf.Remote.Path = path.Join(tmp, "release", release, "conf")
+		writeTestRelease(t, bin.Remote.Path, map[string]string{"app.exe": release})
+		writeTestRelease(t, conf.Remote.Path, map[string]string{"app.json": release})
+		var wg sync.WaitGroup
+		for _, dir := range []*SyncDir{bin, conf} {
+			wg.Add(1)
+			go func(dir *SyncDir) {
+				defer wg.Done()
+				u.fetch(dir)
+				u.Apply()
+			}(dir)
+		}
+		wg.Wait()
+		u.Apply()
+		if readHashFile(bin.LocalPath) != readHashFile(bin.Remote.Path) || readHashFile(conf.LocalPath) != readHashFile(conf.Remote.Path) {
+			t.Fatalf("Release %v was not installed", release)
+		}
+	}
+	if overlaps != 0 {
+		t.Errorf("%v applies overlapped", overlaps)
+	}
+}
@@ -3,9 +3,217 @@
 package updater
 
 import (
-	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 )
 
-func shellMirrorDirectory(src, dst string) error {
-	return errors.New("shellMirrorDirectory: TODO")
+/* Mirror src directory to dst, the same way that robocopy /MIR does on Windows.
+Files that differ in size, modification time or mode are copied to a temporary name
+beside the destination, and then renamed into place, so that a running binary is never
+modified in place. Modes, modification times and symlinks are preserved.
+The files and directories in excludeFiles and excludeDirs (full paths, in src or in dst) are neither
+copied from src, nor touched in dst. An entry without a slash is a name (eg *.log), which is
+excluded at any depth, the same as it is by robocopy.
+*/
+func shellMirrorDirectory(src, dst string, excludeFiles, excludeDirs []string) (string, error) {
+	m := &dirMirror{
+		exclude: map[string]bool{},
+	}
+	for _, name := range excludeFiles {
+		if strings.Contains(name, "/") {
+			m.exclude[path.Clean(name)] = true
+		} else {
+			m.fileNames = append(m.fileNames, name)
+		}
+	}
+	for _, name := range excludeDirs {
+		if strings.Contains(name, "/") {
+			m.exclude[path.Clean(name)] = true
+		} else {
+			m.dirNames = append(m.dirNames, name)
+		}
+	}
+	err := m.mirror(path.Clean(src), path.Clean(dst))
+	return fmt.Sprintf("%v files copied, %v links created, %v removed", m.copied, m.linked, m.removed), err
+}
+
+type dirMirror struct {
+	exclude   map[string]bool
+	fileNames []string
+	dirNames  []string
+	copied    int
+	linked    int
+	removed   int
+}
+
+func (m *dirMirror) mirror(src, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, srcInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	items, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	inSrc := map[string]bool{}
+	for _, item := range items {
+		inSrc[item.Name()] = true
+		s := path.Join(src, item.Name())
+		d := path.Join(dst, item.Name())
+		if m.excluded(s, item.IsDir()) || m.excluded(d, item.IsDir()) {
+			continue
+		}
+		existing, err := os.Lstat(d)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		switch {
+		case item.IsDir():
+			if existing != nil && !existing.IsDir() {
+				if err := os.Remove(d); err != nil {
+					return err
+				}
+			}
+			if err := m.mirror(s, d); err != nil {
+				return err
+			}
+		case item.Mode()&os.ModeSymlink != 0:
+			if err := m.mirrorLink(s, d, existing); err != nil {
+				return err
+			}
+		default:
+			if existing != nil && existing.Mode() == item.Mode() && existing.Size() == item.Size() && existing.ModTime().Equal(item.ModTime()) {
+				continue
+			}
+			if existing != nil && existing.IsDir() {
+				if err := m.removeExtra(d); err != nil {
+					return err
+				}
+			}
+			if err := mirrorFile(s, d, item); err != nil {
+				return err
+			}
+			m.copied++
+		}
+	}
+
+	// Remove everything in dst that is not in src
+	dstItems, err := ioutil.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	for _, item := range dstItems {
+		if !inSrc[item.Name()] {
+			if err := m.removeExtra(path.Join(dst, item.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *dirMirror) mirrorLink(src, dst string, existing os.FileInfo) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Mode()&os.ModeSymlink != 0 {
+		if current, _ := os.Readlink(dst); current == target {
+			return nil
+		}
+	}
+	if existing != nil {
+		if err := m.removeExtra(dst); err != nil {
+			return err
+		}
+	}
+	m.linked++
+	return os.Symlink(target, dst)
+}
+
+func (m *dirMirror) excluded(name string, isDir bool) bool {
+	if m.exclude[name] {
+		return true
+	}
+	names := m.fileNames
+	if isDir {
+		names = m.dirNames
+	}
+	for _, pattern := range names {
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if anything inside 'dir' is excluded
+func (m *dirMirror) holdsExcluded(dir string) bool {
+	for ex := range m.exclude {
+		if strings.HasPrefix(ex, dir+"/") {
+			return true
+		}
+	}
+	if len(m.fileNames)+len(m.dirNames) == 0 {
+		return false
+	}
+	items, _ := ioutil.ReadDir(dir)
+	for _, item := range items {
+		child := path.Join(dir, item.Name())
+		if m.excluded(child, item.IsDir()) || (item.IsDir() && m.holdsExcluded(child)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove 'name', unless it is excluded. If there is anything excluded inside it, then only the rest is removed.
+func (m *dirMirror) removeExtra(name string) error {
+	info, err := os.Lstat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if m.excluded(name, info.IsDir()) {
+		return nil
+	}
+	if !info.IsDir() || !m.holdsExcluded(name) {
+		m.removed++
+		return os.RemoveAll(name)
+	}
+	items, err := ioutil.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := m.removeExtra(path.Join(name, item.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mirrorFile(src, dst string, info os.FileInfo) error {
+	tmp := dst + ".mirror-tmp"
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, info.Mode().Perm()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
 }
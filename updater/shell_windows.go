@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -13,11 +14,26 @@ I'm not sure which is best - mirror or swap old & new directory.
 Mirror has the advantage of keeping unchanged files hot in the OS cache.
 Mirror also has the advantage that, when it's finished, you're left with
 two identical copies. This makes us more ready for the next update.
+The files and directories in excludeFiles and excludeDirs (full paths, or names such as *.log,
+which robocopy matches at any depth) are left untouched in dst.
 */
-func shellMirrorDirectory(src, dst string) (string, error) {
+func shellMirrorDirectory(src, dst string, excludeFiles, excludeDirs []string) (string, error) {
 	//fmt.Printf("-- mirror %v to %v --\n", src, dst)
 	//return nil
-	cmd := exec.Command("robocopy", "/MIR", src, dst)
+	args := []string{"/MIR", src, dst}
+	if len(excludeFiles) != 0 {
+		args = append(args, "/XF")
+		for _, f := range excludeFiles {
+			args = append(args, filepath.FromSlash(f))
+		}
+	}
+	if len(excludeDirs) != 0 {
+		args = append(args, "/XD")
+		for _, d := range excludeDirs {
+			args = append(args, filepath.FromSlash(d))
+		}
+	}
+	cmd := exec.Command("robocopy", args...)
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
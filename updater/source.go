@@ -0,0 +1,379 @@
+package updater
+
+// This deals with the places that releases are downloaded from
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Source is a place where a release can be read from, such as an HTTP server, or a directory
+// on a network share. All names are relative to the root of the release, and use forward slashes.
+type Source interface {
+	// Open a file for reading. The caller must close the returned stream.
+	Open(name string) (io.ReadCloser, error)
+	// A human readable description of where name lives, for logging
+	Describe(name string) string
+}
+
+var ErrFileHashMismatch = errors.New("Downloaded file does not match the hash in the manifest")
+
+// The server asked us to back off, with HTTP 429 (Too Many Requests) or 503 (Service Unavailable)
+type RetryAfterError struct {
+	Url    string
+	Status string
+	After  time.Duration // How long the server asked us to wait, from its Retry-After header. Zero if it did not say.
+}
+
+func (e *RetryAfterError) Error() string {
+	if e.After > 0 {
+		return fmt.Sprintf("Error reading %v: %v (retry after %v)", e.Url, e.Status, e.After)
+	}
+	return "Error reading " + e.Url + ": " + e.Status
+}
+
+// Returns a RetryAfterError if 'res' asks us to back off, or otherwise nil.
+// Retry-After is either a number of seconds, or an HTTP date.
+func retryAfterFromResponse(req *http.Request, res *http.Response, now time.Time) *RetryAfterError {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	e := &RetryAfterError{Url: req.URL.String(), Status: res.Status}
+	if v := strings.TrimSpace(res.Header.Get("Retry-After")); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			e.After = time.Duration(seconds) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil && t.After(now) {
+			e.After = t.Sub(now)
+		}
+	}
+	return e
+}
+
+// A Source that can read the same file from several places, such as a set of mirrors
+type multiSource interface {
+	Source
+	// All of the places that 'file' can be read from, in order of preference
+	alternatives(file *ManifestFile) []Source
+}
+
+// A Source that keeps track of its own health, and so wants to know whether each file that it served matched its hash
+type verifiedSource interface {
+	verified(ok bool)
+}
+
+// A Source that reads compressed siblings (see compress.go), but can also read the file itself, for when the sibling is stale
+type compressedSource interface {
+	openUncompressed(name string) (io.ReadCloser, error)
+}
+
+// Create the Source for 'remote'.
+//
+// remote.Path can be one of the following:
+//
+//	imqsbin/stable                      Relative to deployUrl (eg https://deploy.imqs.co.za/files/imqsbin/stable)
+//	https://example.com/imqsbin/stable  An absolute HTTP or HTTPS URL
+//	file:///c:/deploy/imqsbin/stable    A file URL
+//	c:/deploy/imqsbin/stable            A local directory
+//	\\server\deploy\imqsbin\stable      A UNC share
+//	s3://bucket/imqsbin/stable          An S3-compatible bucket, using the connection details in Config.S3
+func newSource(c *Config, remote RemotePath, client *http.Client) (Source, error) {
+	p := remote.Path
+	switch {
+	case strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://"):
+		return newHttpSource(p, remote, client), nil
+	case strings.HasPrefix(p, "s3://"):
+		return newS3Source(c.S3, remote, client)
+	case strings.HasPrefix(p, "file://"):
+		return &dirSource{root: fileUrlToPath(p)}, nil
+	case isLocalPath(p):
+		return &dirSource{root: p}, nil
+	default:
+		return newHttpSource(c.DeployUrl+"/"+p, remote, client), nil
+	}
+}
+
+// Returns true if p is relative to Config.DeployUrl (as opposed to a URL, or a local path)
+func IsRelativeRemotePath(p string) bool {
+	for _, prefix := range []string{"http://", "https://", "s3://", "file://"} {
+		if strings.HasPrefix(p, prefix) {
+			return false
+		}
+	}
+	return !isLocalPath(p)
+}
+
+// Returns true if p is an absolute local path or a UNC path
+func isLocalPath(p string) bool {
+	if strings.HasPrefix(p, `\\`) || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/") {
+		return true
+	}
+	// Recognize drive letters even when we're not running on Windows, so that configs behave the same everywhere
+	return len(p) >= 3 && p[1] == ':' && (p[2] == '/' || p[2] == '\\') && ((p[0] >= 'a' && p[0] <= 'z') || (p[0] >= 'A' && p[0] <= 'Z'))
+}
+
+// Convert file:///c:/deploy to c:/deploy, file:///srv/deploy to /srv/deploy, and file://server/share to //server/share
+func fileUrlToPath(fileUrl string) string {
+	p := strings.TrimPrefix(fileUrl, "file://")
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		p = unescaped
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "//" + p
+	}
+	if len(p) >= 3 && p[2] == ':' {
+		return p[1:]
+	}
+	return p
+}
+
+// A Source on an HTTP or HTTPS server
+type httpSource struct {
+	client      *http.Client
+	baseUrl     string
+	username    string
+	password    string
+	conditional *conditionalCache // If not nil, then manifest.hash is fetched with a conditional GET
+}
+
+func newHttpSource(baseUrl string, remote RemotePath, client *http.Client) *httpSource {
+	return &httpSource{
+		client:   client,
+		baseUrl:  strings.TrimRight(baseUrl, "/"),
+		username: remote.Username,
+		password: remote.Password,
+	}
+}
+
+func (s *httpSource) url(name string) string {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return s.baseUrl + "/" + strings.Join(parts, "/")
+}
+
+func (s *httpSource) Describe(name string) string {
+	return s.url(name)
+}
+
+func (s *httpSource) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.url(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.username != "" || s.password != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, offset+length-1))
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if ra := retryAfterFromResponse(req, res, time.Now()); ra != nil {
+		res.Body.Close()
+		return nil, ra
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, errors.New("Error reading range of " + req.URL.String() + ": " + res.Status)
+	}
+	return res.Body, nil
+}
+
+func (s *httpSource) Open(name string) (io.ReadCloser, error) {
+	return s.open(name, acceptEncodingHeader())
+}
+
+func (s *httpSource) openUncompressed(name string) (io.ReadCloser, error) {
+	return s.open(name, "identity")
+}
+
+func (s *httpSource) open(name, acceptEncoding string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.url(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.username != "" || s.password != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	// Because we set Accept-Encoding ourselves, the transport leaves decompression up to us
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	var cached *conditionalEntry
+	if s.conditional != nil && name == ManifestFilename_Hash {
+		cached = s.conditional.get(req.URL.String())
+		cached.addHeaders(req)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if ra := retryAfterFromResponse(req, res, time.Now()); ra != nil {
+		res.Body.Close()
+		return nil, ra
+	}
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		res.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(cached.body)), nil
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.New("Error reading " + req.URL.String() + ": " + res.Status)
+	}
+	body := res.Body
+	if ce := res.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		e := findContentEncoding(ce)
+		if e == nil {
+			res.Body.Close()
+			return nil, errors.New("Error reading " + req.URL.String() + ": unsupported Content-Encoding " + ce)
+		}
+		if body, err = decodeStream(e, res.Body); err != nil {
+			// decodeStream has already closed res.Body
+			return nil, err
+		}
+	}
+	if s.conditional != nil && name == ManifestFilename_Hash {
+		return s.conditional.remember(req.URL.String(), res, body)
+	}
+	return body, nil
+}
+
+// A Source on a local disk, or a network share
+type dirSource struct {
+	root           string
+	loadCompressed sync.Once
+	compressed     map[string]bool // Files that have compressed siblings
+}
+
+func (s *dirSource) Describe(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+// If the file has a compressed sibling, then we read that instead, because a network share
+// is often on the far side of a slow link.
+func (s *dirSource) Open(name string) (io.ReadCloser, error) {
+	s.loadCompressed.Do(func() {
+		s.compressed = readCompressedList(s.root)
+	})
+	if s.compressed[name] {
+		for _, e := range contentEncodings {
+			if f, err := os.Open(s.Describe(name + e.extension)); err == nil {
+				return decodeStream(e, f)
+			}
+		}
+	}
+	return os.Open(s.Describe(name))
+}
+
+func (s *dirSource) openUncompressed(name string) (io.ReadCloser, error) {
+	return os.Open(s.Describe(name))
+}
+
+func (s *dirSource) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.Describe(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Download 'name' from 'src' into 'filename'
+func downloadFile(src Source, name, filename string) error {
+	r, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeFileFrom(filename, r)
+}
+
+// Download 'name' from 'src' into 'filename', ignoring any compressed sibling.
+// Returns false if src does not read compressed siblings, in which case there is nothing to retry.
+func downloadFileUncompressed(src Source, name, filename string) (bool, error) {
+	cs, ok := src.(compressedSource)
+	if !ok {
+		return false, nil
+	}
+	r, err := cs.openUncompressed(name)
+	if err != nil {
+		return true, err
+	}
+	defer r.Close()
+	return true, writeFileFrom(filename, r)
+}
+
+// Download 'file' from 'src' into 'filename', and check it against its hash in the manifest.
+// If src is a multiSource, then each alternative is tried in turn, until one of them succeeds.
+func downloadFileVerified(src Source, file *ManifestFile, filename string) error {
+	alternatives := []Source{src}
+	if ms, ok := src.(multiSource); ok {
+		alternatives = ms.alternatives(file)
+	}
+	var firstErr error
+	for _, alt := range alternatives {
+		err := downloadFileAndCheckHash(alt, file, filename)
+		if vs, ok := alt.(verifiedSource); ok && (err == nil || errors.Is(err, ErrFileHashMismatch)) {
+			vs.verified(err == nil)
+		}
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// If the file came from a compressed sibling, and is not what we expected, then we read the file itself instead,
+// because manifest.compressed (or the sibling) may be stale.
+func downloadFileAndCheckHash(src Source, file *ManifestFile, filename string) error {
+	r, err := src.Open(file.Name)
+	if err != nil {
+		return err
+	}
+	_, decoded := r.(*decodingReader)
+	err = writeFileAndCheckHash(src, file, r, filename)
+	r.Close()
+	if cs, ok := src.(compressedSource); ok && decoded && err != nil {
+		if r, err = cs.openUncompressed(file.Name); err != nil {
+			return err
+		}
+		defer r.Close()
+		return writeFileAndCheckHash(src, file, r, filename)
+	}
+	return err
+}
+
+func writeFileAndCheckHash(src Source, file *ManifestFile, r io.Reader, filename string) error {
+	h := sha256.New()
+	if err := writeFileFrom(filename, io.TeeReader(r, h)); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != file.Hash {
+		os.Remove(filename)
+		return fmt.Errorf("%v: %w", src.Describe(file.Name), ErrFileHashMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package updater
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestSourceSelection(t *testing.T) {
+	cases := []struct {
+		remote string
+		isDir  bool
+		where  string
+	}{
+		{"imqsbin/stable", false, "https://deploy.imqs.co.za/files/imqsbin/stable/a%20b.txt"},
+		{"http://example.com/x/", false, "http://example.com/x/a%20b.txt"},
+		{"file:///c:/deploy", true, "c:/deploy"},
+		{"file:///srv/deploy", true, "/srv/deploy"},
+		{"file://server/share", true, "//server/share"},
+		{"c:/deploy", true, "c:/deploy"},
+		{`\\server\share`, true, `\\server\share`},
+	}
+	for _, c := range cases {
+		src, err := newSource(NewConfig(), RemotePath{Path: c.remote}, nil)
+		if err != nil || src == nil {
+			t.Errorf("%v: Expected a source, but got %v", c.remote, err)
+			continue
+		}
+		switch s := src.(type) {
+		case *dirSource:
+			if !c.isDir || s.root != c.where {
+				t.Errorf("%v: Expected %v, but got directory %v", c.remote, c.where, s.root)
+			}
+		case *httpSource:
+			if c.isDir || s.url("a b.txt") != c.where {
+				t.Errorf("%v: Expected %v, but got URL %v", c.remote, c.where, s.url("a b.txt"))
+			}
+		default:
+			t.Errorf("%v: Unexpected source %T", c.remote, src)
+		}
+	}
+}
+
+func TestDownloadFromDirectory(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{
+		"a.txt":       "hello",
+		"sub/b.txt":   "world",
+		"sub/c/d.txt": "hello",
+	})
+	u.Config.BinDir.Remote.Path = release
+
+	u.Download()
+	if ready, err := u.Config.BinDir.isReadyToApply(u.buildManifest); err != nil || !ready {
+		t.Fatalf("Expected download to be ready to apply (%v, %v)", ready, err)
+	}
+	if body, _ := ioutil.ReadFile(path.Join(u.Config.BinDir.LocalPathNext, "sub/c/d.txt")); string(body) != "hello" {
+		t.Errorf("sub/c/d.txt was not downloaded correctly")
+	}
+}
@@ -0,0 +1,178 @@
+package updater
+
+// This deals with the state file, which remembers things about previous cycles, so that
+// "updater-cmd status" can report them. The service and the command line tool both use the
+// file, so every change is a read-modify-write of the file on disk, under a lock file that
+// keeps the two processes from overwriting each other's changes (eg a pause by "updater-cmd rollback").
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long we wait for another process to finish with the state file. A lock file that is older than
+// this belongs to a process that died while holding it.
+const stateLockTimeout = 10 * time.Second
+
+// Things that we remember between cycles
+type State struct {
+	LastCycle    time.Time // When the last full cycle (download, apply) finished
+	LastError    string    // The last error of that cycle, or empty if it succeeded
+	Paused       bool      // Automatic updates are paused (eg after a rollback)
+	PausedReason string
+	Dirs         map[string]*DirState // Key is SyncDir.LocalPath
+}
+
+// Things that we remember about a single SyncDir
+type DirState struct {
+	LastCheck     time.Time // When the remote manifest.hash was last fetched successfully
+	LastApply     time.Time // When a release was last installed into LocalPath
+	LastApplyHash string    // The manifest.hash of that release
+
+	RolledBackFrom []string `json:",omitempty"` // Releases that rollbacks have replaced since the last resume, which a rollback must not go back to
+
+	InsufficientSpace *InsufficientSpaceError `json:",omitempty"` // Set if the last disk space check failed
+}
+
+// Returns the state of syncDir, creating it if necessary
+func (s *State) dir(syncDir *SyncDir) *DirState {
+	if s.Dirs == nil {
+		s.Dirs = map[string]*DirState{}
+	}
+	ds := s.Dirs[syncDir.LocalPath]
+	if ds == nil {
+		ds = &DirState{}
+		s.Dirs[syncDir.LocalPath] = ds
+	}
+	return ds
+}
+
+// Read the state file. A missing or corrupt file yields an empty state.
+func (u *Updater) readState() *State {
+	s := &State{}
+	if u.Config.StateFile == "" {
+		return s
+	}
+	if raw, err := ioutil.ReadFile(u.Config.StateFile); err == nil {
+		if json.Unmarshal(raw, s) != nil {
+			s = &State{}
+		}
+	}
+	return s
+}
+
+// Apply 'change' to the state file. Failures are logged, because the state is informational.
+func (u *Updater) updateState(change func(s *State)) {
+	if u.Config.StateFile == "" {
+		return
+	}
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	unlock, err := lockFile(u.Config.StateFile + ".lock")
+	if err != nil {
+		u.log.Warnf("Failed to update state file %v: %v", u.Config.StateFile, err)
+		return
+	}
+	defer unlock()
+	s := u.readState()
+	change(s)
+	raw, err := json.MarshalIndent(s, "", "\t")
+	if err == nil {
+		tmp := u.Config.StateFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, raw, newFilePerms); err == nil {
+			err = os.Rename(tmp, u.Config.StateFile)
+		}
+	}
+	if err != nil {
+		u.log.Warnf("Failed to write state file %v: %v", u.Config.StateFile, err)
+	}
+}
+
+var errLockHeld = errors.New("Lock is held by another process")
+
+// Take a lock that is shared between processes, by creating 'filename'. Call the returned function to release it.
+func lockFile(filename string) (unlock func(), err error) {
+	start := time.Now()
+	for {
+		unlock, err := tryLockFile(filename)
+		if err != errLockHeld {
+			return unlock, err
+		}
+		if time.Since(start) > stateLockTimeout {
+			return nil, fmt.Errorf("Timed out waiting for the lock %v", filename)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Make a single attempt at taking the lock 'filename'. Returns errLockHeld if somebody else holds it.
+// While we hold the lock, we keep touching it, so that a long hold is not mistaken for a dead holder.
+func tryLockFile(filename string) (unlock func(), err error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, newFilePerms)
+	if err == nil {
+		f.Close()
+		return holdLockFile(filename), nil
+	}
+	if !os.IsExist(err) {
+		return nil, err
+	}
+	if isStaleLock(filename) {
+		breakStaleLock(filename)
+	}
+	return nil, errLockHeld
+}
+
+func holdLockFile(filename string) (unlock func()) {
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(stateLockTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				os.Chtimes(filename, now, now)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			os.Remove(filename)
+		})
+	}
+}
+
+func isStaleLock(filename string) bool {
+	info, err := os.Stat(filename)
+	return err == nil && time.Since(info.ModTime()) > stateLockTimeout
+}
+
+// Remove a lock whose holder died. Two processes can see the same stale lock, and if both of them
+// removed it, then the second one could remove the lock that the first one had just taken. So only the
+// process that manages to create the takeover file may remove the lock, and it checks again first.
+func breakStaleLock(filename string) {
+	takeover := filename + ".takeover"
+	f, err := os.OpenFile(takeover, os.O_CREATE|os.O_EXCL|os.O_WRONLY, newFilePerms)
+	if err != nil {
+		// Somebody else is busy with the takeover. It only takes a moment, so if the takeover file is old,
+		// then that process died while holding it.
+		if isStaleLock(takeover) {
+			os.Remove(takeover)
+		}
+		time.Sleep(10 * time.Millisecond)
+		return
+	}
+	f.Close()
+	defer os.Remove(takeover)
+	if isStaleLock(filename) {
+		os.Remove(filename)
+	}
+}
@@ -0,0 +1,103 @@
+package updater
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The service and updater-cmd are separate processes, each with its own Updater
+func TestStateUpdatesFromTwoProcessesAreNotLost(t *testing.T) {
+	tmp := t.TempDir()
+	service := newTestUpdater(t, tmp)
+	cmd := newTestUpdater(t, tmp)
+	if service.Config.StateFile != cmd.Config.StateFile {
+		t.Fatalf("Expected both updaters to share a state file")
+	}
+	var wg sync.WaitGroup
+	for _, u := range []*Updater{service, cmd} {
+		wg.Add(1)
+		go func(u *Updater) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				dir := &SyncDir{LocalPath: path.Join(tmp, fmt.Sprintf("%p-%v", u, i))}
+				u.updateState(func(s *State) {
+					s.dir(dir).LastApplyHash = "x"
+				})
+			}
+		}(u)
+	}
+	wg.Wait()
+	if n := len(service.readState().Dirs); n != 100 {
+		t.Errorf("Expected 100 dirs in the state, but found %v", n)
+	}
+}
+
+// Every locker sees the stale lock at the same time, but only one of them may hold the lock at once
+func TestStaleLockIsTakenOverByOneProcess(t *testing.T) {
+	filename := path.Join(t.TempDir(), "state.json.lock")
+	for round := 0; round < 50; round++ {
+		if err := ioutil.WriteFile(filename, nil, newFilePerms); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-2 * stateLockTimeout)
+		os.Chtimes(filename, old, old)
+		var wg sync.WaitGroup
+		var holders, maxHolders int32
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				unlock, err := lockFile(filename)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := atomic.AddInt32(&holders, 1)
+				for {
+					m := atomic.LoadInt32(&maxHolders)
+					if n <= m || atomic.CompareAndSwapInt32(&maxHolders, m, n) {
+						break
+					}
+				}
+				time.Sleep(2 * time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+				unlock()
+			}()
+		}
+		wg.Wait()
+		if maxHolders != 1 {
+			t.Fatalf("Expected one holder of the lock at a time, but %v held it at once", maxHolders)
+		}
+	}
+}
+
+// A locker that saw the lock go stale must not remove it once somebody else has taken it over
+func TestFreshLockIsNotBroken(t *testing.T) {
+	filename := path.Join(t.TempDir(), "state.json.lock")
+	unlock, err := lockFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	breakStaleLock(filename)
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("Expected the fresh lock to survive, but %v", err)
+	}
+
+	// Nor may it remove a stale lock while another process is busy taking it over
+	old := time.Now().Add(-2 * stateLockTimeout)
+	os.Chtimes(filename, old, old)
+	if err := ioutil.WriteFile(filename+".takeover", nil, newFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	breakStaleLock(filename)
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("Expected the lock to be left to the process that is taking it over, but %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package updater
+
+// This deals with answering the question "is this machine up to date?".
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Exit codes of "updater-cmd status", for use by monitoring scripts
+const (
+	StatusUpToDate      = 0 // Every dir has the remote release installed
+	StatusError         = 1 // A remote could not be reached, or something else went wrong
+	StatusUpdatePending = 2 // A newer release is available, or staged and waiting to be applied
+)
+
+// The state of one SyncDir
+type DirStatus struct {
+	Name              string
+	LocalPath         string
+	RemotePath        string
+	CurrentHash       string
+	StagedHash        string
+	RemoteHash        string
+	RemoteError       string                  `json:",omitempty"` // Why the remote hash could not be fetched
+	UpToDate          bool                    // The remote release is installed
+	ReadyToApply      bool                    // The next apply would install the staged release
+	NotReadyReason    string                  `json:",omitempty"` // Why ReadyToApply is false
+	InsufficientSpace *InsufficientSpaceError `json:",omitempty"` // Set if the last disk space check failed
+	LastCheck         time.Time
+	LastApply         time.Time
+}
+
+type ServiceStatus struct {
+	Name    string
+	Running bool
+}
+
+type Status struct {
+	Dirs         []*DirStatus
+	Services     []ServiceStatus
+	LastCycle    time.Time
+	LastError    string
+	Paused       bool // Automatic updates are paused, until "updater-cmd resume"
+	PausedReason string
+}
+
+// Gather the state of every SyncDir and service. This only reads; nothing is staged or applied.
+func (u *Updater) Status() *Status {
+	state := u.readState()
+	st := &Status{
+		LastCycle:    state.LastCycle,
+		LastError:    state.LastError,
+		Paused:       state.Paused,
+		PausedReason: state.PausedReason,
+	}
+	ready := []*SyncDir{}
+	for _, dir := range u.Config.allSyncDirs() {
+		ds := &DirStatus{
+			Name:              dir.Name,
+			LocalPath:         dir.LocalPath,
+			RemotePath:        dir.Remote.Path,
+			CurrentHash:       readHashFile(dir.LocalPath),
+			StagedHash:        readHashFile(dir.LocalPathNext),
+			LastCheck:         state.dir(dir).LastCheck,
+			LastApply:         state.dir(dir).LastApply,
+			InsufficientSpace: state.dir(dir).InsufficientSpace,
+		}
+		if hash, err := u.fetchRemoteHash(dir); err != nil {
+			ds.RemoteError = err.Error()
+		} else {
+			ds.RemoteHash = hash
+			ds.UpToDate = hash == ds.CurrentHash
+		}
+		ds.NotReadyReason = dir.notReadyReason(u.syncDirManifestBuilder(dir))
+		ds.ReadyToApply = ds.NotReadyReason == ""
+		st.Dirs = append(st.Dirs, ds)
+		if ds.ReadyToApply {
+			ready = append(ready, dir)
+		}
+	}
+	ready, held := u.holdBackForWindow(ready, time.Now())
+	_, heldUncoupled := u.holdBackUncoupled(ready)
+	for dir, reason := range heldUncoupled {
+		held[dir] = reason
+	}
+	for i, dir := range u.Config.allSyncDirs() {
+		if reason, ok := held[dir]; ok {
+			st.Dirs[i].NotReadyReason = reason
+			st.Dirs[i].ReadyToApply = false
+		}
+	}
+	for _, name := range imqsServiceNames(u, u.Config.allSyncDirs()) {
+		st.Services = append(st.Services, ServiceStatus{name, isServiceRunning(name)})
+	}
+	return st
+}
+
+// Read manifest.hash from the remote, without storing it anywhere
+func (u *Updater) fetchRemoteHash(syncDir *SyncDir) (string, error) {
+	src, err := u.source(syncDir)
+	if err != nil {
+		return "", err
+	}
+	r, err := src.Open(ManifestFilename_Hash)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// Returns an empty string if isReadyToApply would be true, or otherwise the reason why not
+func (s *SyncDir) notReadyReason(build manifestBuilder) string {
+	if _, err := os.Stat(path.Join(s.LocalPathNext, ManifestFilename_Hash)); err != nil {
+		return "Nothing is staged"
+	}
+	if !s.manifestHashIsReadableAndNew() {
+		if readHashFile(s.LocalPath) == readHashFile(s.LocalPathNext) {
+			return "The staged release is already installed"
+		}
+		return "The current or staged manifest.hash cannot be read"
+	}
+	ok, err := s.isStagedConsistent(build)
+	if err != nil {
+		return fmt.Sprintf("The staged release is inconsistent: %v", err)
+	} else if !ok {
+		return "The staged files do not match the staged manifest (the download is incomplete)"
+	}
+	return ""
+}
+
+// Returns StatusUpToDate, StatusError or StatusUpdatePending
+func (st *Status) ExitCode() int {
+	code := StatusUpToDate
+	for _, ds := range st.Dirs {
+		if ds.RemoteError != "" {
+			return StatusError
+		}
+		if !ds.UpToDate || ds.ReadyToApply {
+			code = StatusUpdatePending
+		}
+	}
+	return code
+}
+
+func (st *Status) WriteText(w io.Writer) {
+	for _, ds := range st.Dirs {
+		fmt.Fprintf(w, "%v: %v (from %v)\n", ds.Name, ds.LocalPath, ds.RemotePath)
+		fmt.Fprintf(w, "  current  %v\n  staged   %v\n", describeHash(ds.CurrentHash), describeHash(ds.StagedHash))
+		if ds.RemoteError != "" {
+			fmt.Fprintf(w, "  remote   error: %v\n", ds.RemoteError)
+		} else if ds.UpToDate {
+			fmt.Fprintf(w, "  remote   %v (up to date)\n", ds.RemoteHash)
+		} else {
+			fmt.Fprintf(w, "  remote   %v (update available)\n", ds.RemoteHash)
+		}
+		if ds.ReadyToApply {
+			fmt.Fprintf(w, "  ready    yes\n")
+		} else {
+			fmt.Fprintf(w, "  ready    no (%v)\n", ds.NotReadyReason)
+		}
+		if ds.InsufficientSpace != nil {
+			fmt.Fprintf(w, "  disk     %v\n", ds.InsufficientSpace)
+		}
+		fmt.Fprintf(w, "  checked  %v\n  applied  %v\n", describeTime(ds.LastCheck), describeTime(ds.LastApply))
+	}
+	for _, s := range st.Services {
+		running := "stopped"
+		if s.Running {
+			running = "running"
+		}
+		fmt.Fprintf(w, "service %v: %v\n", s.Name, running)
+	}
+	if st.Paused {
+		fmt.Fprintf(w, "automatic updates are paused (%v)\n", st.PausedReason)
+	}
+	fmt.Fprintf(w, "last cycle %v", describeTime(st.LastCycle))
+	if st.LastError != "" {
+		fmt.Fprintf(w, ", error: %v", st.LastError)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+func describeTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,33 @@
+package updater
+
+import (
+	"path"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{"a.txt": "hello"})
+	u.Config.BinDir.Remote.Path = release
+
+	st := u.Status()
+	if ds := st.Dirs[0]; ds.UpToDate || ds.ReadyToApply || ds.NotReadyReason != "Nothing is staged" || ds.RemoteHash != readHashFile(release) {
+		t.Errorf("Unexpected status before download %+v", ds)
+	}
+	if st.ExitCode() != StatusUpdatePending {
+		t.Errorf("Expected StatusUpdatePending, but got %v", st.ExitCode())
+	}
+
+	u.Download()
+	st = u.Status()
+	if ds := st.Dirs[0]; !ds.ReadyToApply || ds.LastCheck.IsZero() || !ds.LastApply.IsZero() {
+		t.Errorf("Unexpected status after download %+v", ds)
+	}
+
+	u.Config.BinDir.Remote.Path = path.Join(tmp, "missing")
+	if st = u.Status(); st.ExitCode() != StatusError || st.Dirs[0].RemoteError == "" {
+		t.Errorf("Expected an unreachable remote to be an error (%v)", st.ExitCode())
+	}
+}
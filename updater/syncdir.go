@@ -11,14 +11,34 @@ import (
 type RemotePath struct {
 	Username string // Sent via HTTP BASIC authorization
 	Password string // Sent via HTTP BASIC authorization
-	Path     string // Typically a URL (eg https://deploy.imqs.co.za/files/stable)
+	Path     string // Relative to Config.DeployUrl (eg imqsbin/stable), or a URL, file:// URL, local directory or UNC share. See newSource.
 }
 
 // A directory that is synchronized
 type SyncDir struct {
+	Name          string     // Unique name, used in logs and by ServicesFrom (eg bin)
 	Remote        RemotePath // Remote directory (eg imqsbin@deploy.imqs.co.za:imqsbin/stable)
 	LocalPath     string     // Current directory (eg c:\imqsbin)
 	LocalPathNext string     // Staging directory, where we synchronize to before atomically replacing LocalPath (eg c:\imqsbin_next)
+	Ignore        []string   // Local-only paths, in .gitignore syntax, which are never deleted or overwritten (eg ["*.log", "cache/"]). See also .updaterignore.
+
+	CheckIntervalSeconds float64  // 0 (How often the remote is checked. 0 = Config.CheckIntervalSeconds)
+	Schedule             string   // 30 2 * * * (optional. When the remote is checked, as a cron expression. Overrides CheckIntervalSeconds. See schedule.go)
+	JitterSeconds        float64  // 0 (A random delay of up to this much is added to every check. 0 = Config.CheckJitterSeconds)
+	Services             []string // Services that are stopped while this dir is installed (eg ["ImqsMaps"])
+	ServiceListFile      string   // A file in the release that lists more such services, one per line (eg servicenames)
+	ServicesFrom         []string // Names of other SyncDirs whose services are also stopped while this dir is installed (eg ["bin"])
+	BeforeApply          []string // Command that is run after services are stopped, and before this dir is installed (eg ["c:/imqsbin/backup.bat"]). If it fails, the update is abandoned.
+	AfterApply           []string // Command that is run after this dir is installed, and before services are started again (not if the install failed)
+	ServeToPeers         bool     // false (Serve this dir to LAN peers on Config.PeerListen. Off by default, because peers get its files without Remote's credentials)
+}
+
+// Returns the name of the SyncDir, for messages
+func (s *SyncDir) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.LocalPath
 }
 
 func (s *SyncDir) manifestHashIsReadableAndNew() bool {
@@ -42,14 +62,19 @@ func (s *SyncDir) manifestHashIsReadableAndNew() bool {
 
 * manifest.hash is different in LocalPath and LocalPathNext
 * Inside LocalPathNext, manifest.content is consistent with manifest.hash
-* Inside LocalPathNext, manifest.content is consistent with files on disk
+* Inside LocalPathNext, manifest.content is consistent with files on disk (according to 'build')
 
  */
-func (s *SyncDir) isReadyToApply() (bool, error) {
+func (s *SyncDir) isReadyToApply(build manifestBuilder) (bool, error) {
 	if !s.manifestHashIsReadableAndNew() {
 		return false, nil
 	}
-	manifest_truth, err := BuildManifest(s.LocalPathNext)
+	return s.isStagedConsistent(build)
+}
+
+// Like isReadyToApply, but does not care whether LocalPathNext holds a different release than LocalPath
+func (s *SyncDir) isStagedConsistent(build manifestBuilder) (bool, error) {
+	manifest_truth, err := build(s.LocalPathNext)
 	if err != nil {
 		return false, err
 	}
@@ -57,10 +82,11 @@ func (s *SyncDir) isReadyToApply() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	if !bytes.Equal(manifest_truth.hash(), manifest_file.hash()) {
+	manifest_truth.adoptReleaseInfo(manifest_file)
+	if !bytes.Equal(manifest_truth.hash(), manifest_file.hash()) || manifest_truth.extHash() != manifest_file.extHash() {
 		return false, nil
 	}
-	consistent := manifest_truth.isConsistentWithHash(s.LocalPathNext)
+	consistent := manifest_file.isConsistentWithHash(s.LocalPathNext)
 	if consistent != nil {
 		return false, consistent
 	}
@@ -0,0 +1,136 @@
+package updater
+
+// This makes an apply of several SyncDirs behave as one transaction.
+//
+// New binaries must not end up running with old config, so either all of the ready dirs are
+// installed, or none of them are. Before services are stopped, every dir is mirrored into a
+// snapshot beside it (eg c:/imqsbin.snapshot). The snapshot is kept between applies, so taking
+// it again is cheap, but it does take as much space as the dir itself. If any dir then fails to
+// mirror, every dir that was touched is restored from its snapshot before services are started
+// again, so a dir is never left half-installed, even when it is applied on its own. Sites that
+// cannot spare the space can set Config.DisableSnapshots, in which case a failed dir is left as
+// it is, for the next apply to fix.
+//
+// The outcome of every apply is appended to Config.JournalFile, one line of JSON per apply.
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+const (
+	JournalApplied       = "applied"        // All dirs were installed
+	JournalRolledBack    = "rolled back"    // A dir failed to install, and all dirs were restored
+	JournalRestoreFailed = "restore failed" // A dir failed to install, and restoring the snapshots also failed
+	JournalAborted       = "aborted"        // Nothing was changed (eg a snapshot or beforeSync failed)
+	JournalFailed        = "failed"         // A dir failed to install, and was left as it is, because snapshots are disabled
+)
+
+// A line in the journal
+type JournalEntry struct {
+	Time    time.Time
+	Outcome string // One of the Journal* constants
+	Error   string `json:",omitempty"`
+	Dirs    []*JournalDir
+}
+
+// A SyncDir that took part in an apply
+type JournalDir struct {
+	LocalPath string
+	FromHash  string // manifest.hash of LocalPath before the apply
+	ToHash    string // manifest.hash of LocalPathNext
+}
+
+type applyTransaction struct {
+	entry     JournalEntry
+	snapshots bool // The dirs are snapshotted, so that they can be restored together
+}
+
+func (u *Updater) newApplyTransaction(dirs []*SyncDir) *applyTransaction {
+	t := &applyTransaction{
+		snapshots: !u.Config.DisableSnapshots,
+	}
+	for _, dir := range dirs {
+		t.entry.Dirs = append(t.entry.Dirs, &JournalDir{
+			LocalPath: dir.LocalPath,
+			FromHash:  readHashFile(dir.LocalPath),
+			ToHash:    readHashFile(dir.LocalPathNext),
+		})
+	}
+	return t
+}
+
+// Record the outcome of the transaction in the journal
+func (t *applyTransaction) finish(u *Updater, outcome string, err error) {
+	t.entry.Time = time.Now().UTC()
+	t.entry.Outcome = outcome
+	if err != nil {
+		t.entry.Error = err.Error()
+	}
+	if err := u.appendJournal(&t.entry); err != nil {
+		u.log.Warnf("Failed to write journal %v: %v", u.Config.JournalFile, err)
+	}
+}
+
+func (u *Updater) appendJournal(entry *JournalEntry) error {
+	if u.Config.JournalFile == "" {
+		return nil
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(u.Config.JournalFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, newFilePerms)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(raw, '\n'))
+	return err
+}
+
+func snapshotPath(syncDir *SyncDir) string {
+	return syncDir.LocalPath + ".snapshot"
+}
+
+// Bring the snapshot of syncDir up to date with LocalPath. Local-only files are not part of the snapshot,
+// because the mirror never touches them.
+func (u *Updater) snapshotDir(syncDir *SyncDir) error {
+	snapshot := snapshotPath(syncDir)
+	if _, err := os.Stat(syncDir.LocalPath); os.IsNotExist(err) {
+		// Nothing installed yet, so a restore must leave LocalPath empty
+		if err := os.RemoveAll(snapshot); err != nil {
+			return err
+		}
+		return os.MkdirAll(snapshot, newDirPerms)
+	}
+	release, err := ReadManifest(syncDir.LocalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	excludeFiles, excludeDirs, err := syncDir.ignoreRules(release).mirrorExcludes(syncDir.LocalPath)
+	if err != nil {
+		return err
+	}
+	msg, err := u.mirrorDirectory(syncDir.LocalPath, snapshot, excludeFiles, excludeDirs)
+	if err != nil {
+		u.log.Errorf("stdout from shell mirror: %v", msg)
+	}
+	return err
+}
+
+// Restore each of 'dirs' from its snapshot, and return the journal outcome
+func (u *Updater) restoreSnapshots(dirs []*SyncDir) string {
+	outcome := JournalRolledBack
+	for _, dir := range dirs {
+		u.log.Infof("Restoring %v from %v", dir.LocalPath, snapshotPath(dir))
+		msg, err := u.mirrorOnto(dir, snapshotPath(dir))
+		if err != nil {
+			u.errorf("Failed to restore %v from %v: %v", dir.LocalPath, snapshotPath(dir), err)
+			u.log.Errorf("stdout from shell mirror: %v", msg)
+			outcome = JournalRestoreFailed
+		}
+	}
+	return outcome
+}
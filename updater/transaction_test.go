@@ -0,0 +1,151 @@
+// +build !windows
+
+package updater
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func readTestJournal(t *testing.T, u *Updater) []*JournalEntry {
+	raw, err := ioutil.ReadFile(u.Config.JournalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []*JournalEntry{}
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		e := &JournalEntry{}
+		if err := json.Unmarshal([]byte(line), e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestApplyIsTransactional(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	afterSyncCalls := 0
+	lastApplied := false
+	u.afterSync = func(upd *Updater, updatedDirs []*SyncDir, applied bool) {
+		afterSyncCalls++
+		lastApplied = applied
+	}
+	bin := &u.Config.BinDir
+	conf := &u.Config.ConfDir
+	conf.LocalPath = path.Join(tmp, "conf")
+	conf.LocalPathNext = path.Join(tmp, "conf_next")
+
+	install := func(name string) {
+		bin.Remote.Path = path.Join(tmp, "release", name, "bin")
+		conf.Remote.Path = path.Join(tmp, "release", name, "conf")
+		writeTestRelease(t, bin.Remote.Path, map[string]string{"app.exe": name})
+		writeTestRelease(t, conf.Remote.Path, map[string]string{"app.json": name})
+		u.Download()
+		u.Apply()
+	}
+
+	install("one")
+	oldBin, oldConf := readHashFile(bin.LocalPath), readHashFile(conf.LocalPath)
+	if oldBin == "" || oldConf == "" {
+		t.Fatal("First release was not installed")
+	}
+
+	// Fail while mirroring conf, after bin has already been mirrored
+	u.mirrorDirectory = func(src, dst string, excludeFiles, excludeDirs []string) (string, error) {
+		if src == conf.LocalPathNext {
+			return "", errors.New("disk on fire")
+		}
+		return shellMirrorDirectory(src, dst, excludeFiles, excludeDirs)
+	}
+	install("two")
+	if readHashFile(bin.LocalPath) != oldBin || readHashFile(conf.LocalPath) != oldConf {
+		t.Fatal("Expected both dirs to be restored")
+	}
+	if drift, err := u.Verify(bin.LocalPath); err != nil || !drift.IsEmpty() {
+		t.Errorf("Restored bin is not intact (%+v, %v)", drift, err)
+	}
+	if afterSyncCalls != 2 {
+		t.Errorf("Expected afterSync to run after the failed apply too, but it ran %v times", afterSyncCalls)
+	}
+	if lastApplied {
+		t.Errorf("Expected afterSync to be told that the apply was rolled back")
+	}
+	if s := u.readState(); s.dir(bin).LastApplyHash != oldBin {
+		t.Errorf("Failed apply must not be recorded as the last apply")
+	}
+
+	journal := readTestJournal(t, u)
+	if len(journal) != 2 || journal[0].Outcome != JournalApplied || journal[1].Outcome != JournalRolledBack {
+		t.Fatalf("Unexpected journal %+v", journal)
+	}
+	last := journal[1]
+	if !strings.Contains(last.Error, "disk on fire") || len(last.Dirs) != 2 || last.Dirs[0].FromHash != oldBin || last.Dirs[0].ToHash != readHashFile(bin.Remote.Path) {
+		t.Errorf("Unexpected journal entry %+v", last)
+	}
+
+	// Once the fault is gone, both dirs are installed together
+	u.mirrorDirectory = shellMirrorDirectory
+	u.Apply()
+	if readHashFile(bin.LocalPath) != readHashFile(bin.Remote.Path) || readHashFile(conf.LocalPath) != readHashFile(conf.Remote.Path) {
+		t.Error("Expected second release to be installed")
+	}
+}
+
+func TestSingleDirApplyIsRestored(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	bin := &u.Config.BinDir
+	bin.Remote.Path = path.Join(tmp, "release")
+	writeTestRelease(t, bin.Remote.Path, map[string]string{"app.exe": "one", "app.dll": "one"})
+	u.Download()
+	u.Apply()
+	oldBin := readHashFile(bin.LocalPath)
+	if oldBin != readHashFile(bin.Remote.Path) {
+		t.Fatal("Expected the release to be installed")
+	}
+
+	// Fail half way through the mirror, after one file has been replaced
+	halfMirror := func(src, dst string, excludeFiles, excludeDirs []string) (string, error) {
+		if src == bin.LocalPathNext {
+			ioutil.WriteFile(path.Join(dst, "app.exe"), []byte("two"), 0666)
+			return "", errors.New("disk on fire")
+		}
+		return shellMirrorDirectory(src, dst, excludeFiles, excludeDirs)
+	}
+	writeTestRelease(t, bin.Remote.Path, map[string]string{"app.exe": "two", "app.dll": "two"})
+	u.Download()
+	u.mirrorDirectory = halfMirror
+	u.Apply()
+	if readHashFile(bin.LocalPath) != oldBin {
+		t.Fatal("Expected the dir to be restored")
+	}
+	if drift, err := u.Verify(bin.LocalPath); err != nil || !drift.IsEmpty() {
+		t.Errorf("Restored dir is not intact (%+v, %v)", drift, err)
+	}
+	journal := readTestJournal(t, u)
+	if len(journal) != 2 || journal[1].Outcome != JournalRolledBack {
+		t.Errorf("Unexpected journal %+v", journal)
+	}
+
+	// With snapshots disabled, a failed dir is left as it is
+	u.Config.DisableSnapshots = true
+	os.RemoveAll(snapshotPath(bin))
+	u.Apply()
+	if _, err := os.Stat(snapshotPath(bin)); !os.IsNotExist(err) {
+		t.Errorf("Expected no snapshot when snapshots are disabled")
+	}
+	journal = readTestJournal(t, u)
+	if len(journal) != 3 || journal[2].Outcome != JournalFailed {
+		t.Errorf("Unexpected journal %+v", journal)
+	}
+}
@@ -1,14 +1,14 @@
 package updater
 
 import (
-	"errors"
-	//"fmt"
+	"fmt"
 	"github.com/IMQS/log"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -46,11 +46,24 @@ If the hash differs from the current state, then we proceed with a full sync.
 
 */
 type Updater struct {
-	Config     *Config
-	log        *log.Logger
-	httpClient *http.Client
-	beforeSync func(upd *Updater, updatedDirs []*SyncDir) error
-	afterSync  func(upd *Updater, updatedDirs []*SyncDir)
+	Config       *Config
+	log          *log.Logger
+	httpClient   *http.Client
+	beforeSync   func(upd *Updater, updatedDirs []*SyncDir) error
+	afterSync    func(upd *Updater, updatedDirs []*SyncDir, applied bool)
+	lastError    string // Most recent error during the current cycle, reported in check-ins
+	mirrorHealth *mirrorHealth
+	peerClient   *http.Client
+	stateLock    sync.Mutex          // Guards read-modify-write cycles of Config.StateFile
+	applyLock    sync.Mutex          // Applies stop services, so they must never overlap
+	busyLock     sync.Mutex          // Guards busyDirs
+	busyDirs     map[*SyncDir]func() // Releases the lock file of each busy dir
+	errorLock    sync.Mutex          // Guards lastError, which is set by the goroutines of all SyncDirs
+	conditional  *conditionalCache   // Validators of manifest.hash, for conditional GETs
+
+	mirrorDirectory func(src, dst string, excludeFiles, excludeDirs []string) (string, error) // shellMirrorDirectory, except in tests
+	freeDiskSpace   func(dir string) (int64, error)                                           // freeDiskSpace, except in tests
+	volumeOf        func(dir string) string                                                   // volumeOf, except in tests
 }
 
 // Create a new updater
@@ -60,6 +73,13 @@ func NewUpdater() *Updater {
 	u.httpClient = http.DefaultClient
 	u.beforeSync = beforeSyncImqs
 	u.afterSync = afterSyncImqs
+	u.mirrorDirectory = shellMirrorDirectory
+	u.freeDiskSpace = freeDiskSpace
+	u.volumeOf = volumeOf
+	u.busyDirs = map[*SyncDir]func(){}
+	u.conditional = newConditionalCache()
+	u.mirrorHealth = newMirrorHealth()
+	u.peerClient = newPeerClient()
 	return u
 }
 
@@ -79,11 +99,33 @@ func (u *Updater) RunAsService() bool {
 	})
 }
 
-// Run the updater forever
+// Run the updater forever.
+// Every SyncDir is checked by its own goroutine, on its own schedule (see schedule.go). This loop
+// imports dropped bundles, and reports our state, every CheckIntervalSeconds.
 func (u *Updater) Run() {
+	go u.servePeers()
+	delay := randomDuration(u.Config.StartupDelaySeconds)
+	u.log.Infof("Waiting %.0f seconds before the first check", delay.Seconds())
+	time.Sleep(delay)
+	for _, dir := range u.Config.allSyncDirs() {
+		go u.runSyncDir(dir)
+	}
 	for {
-		u.Download()
-		u.Apply()
+		if state := u.readState(); state.Paused {
+			u.log.Infof("Automatic updates are paused (%v). Run 'updater-cmd resume' to resume them.", state.PausedReason)
+		} else {
+			u.importDroppedBundles()
+			u.Apply()
+		}
+		reported := u.getLastError()
+		u.updateState(func(s *State) {
+			s.LastCycle = time.Now().UTC()
+			s.LastError = reported
+		})
+		if err := u.sendCheckin(); err != nil {
+			u.log.Warnf("Failed to send check-in: %v", err)
+		}
+		u.clearLastError(reported)
 		time.Sleep(time.Duration(u.Config.CheckIntervalSeconds) * time.Second)
 	}
 }
@@ -95,82 +137,221 @@ func (u *Updater) Download() {
 	}
 }
 
-func (u *Updater) fetch(syncDir *SyncDir) {
+// Check syncDir for new content, and download it. Returns the first error, which callers may use
+// to back off (see RetryAfterError). Errors are also logged.
+func (u *Updater) fetch(syncDir *SyncDir) error {
+	u.waitAndClaimDir(syncDir)
+	defer u.releaseDir(syncDir)
+
 	// Allow syncing onto a clean system with nothing pre-installed
 	if err := u.ensureDirExists(syncDir.LocalPath); err != nil {
-		u.log.Errorf("Failed to create directory %v: %v", syncDir.LocalPath, err)
-		return
+		u.errorf("Failed to create directory %v: %v", syncDir.LocalPath, err)
+		return err
 	}
 	if err := u.ensureDirExists(syncDir.LocalPathNext); err != nil {
-		u.log.Errorf("Failed to create directory %v: %v", syncDir.LocalPathNext, err)
-		return
+		u.errorf("Failed to create directory %v: %v", syncDir.LocalPathNext, err)
+		return err
+	}
+
+	// Use the same source for the hash and the content, so that both come from the same mirror
+	src, err := u.source(syncDir)
+	if err != nil {
+		u.errorf("Invalid remote path %v: %v", syncDir.Remote.Path, err)
+		return err
 	}
 
 	// Actually do the downloading
-	u.downloadHash(syncDir)
+	err = u.downloadHash(syncDir, src)
+	if err == nil {
+		u.updateState(func(s *State) {
+			s.dir(syncDir).LastCheck = time.Now().UTC()
+		})
+	}
 	if syncDir.manifestHashIsReadableAndNew() {
 		u.log.Infof("New content available on %v. Fetching content.", syncDir.LocalPath)
-		u.downloadContent(syncDir)
+		if errContent := u.downloadContent(syncDir, src); err == nil {
+			err = errContent
+		}
 	}
+	return err
 }
 
-// Run the updater once, if new content is ready to deploy
+// Run the updater once, if new content is ready to deploy, and we are inside a maintenance window
 func (u *Updater) Apply() {
+	u.apply(false)
+}
+
+// Like Apply, but ignore the maintenance windows
+func (u *Updater) ApplyNow() {
+	u.apply(true)
+}
+
+func (u *Updater) apply(ignoreWindows bool) {
 	ready := []*SyncDir{}
 	for _, dir := range u.Config.allSyncDirs() {
-		isReady, err := dir.isReadyToApply()
+		// A dir that is busy downloading is not ready
+		if !u.claimDir(dir) {
+			continue
+		}
+		defer u.releaseDir(dir)
+		isReady, err := dir.isReadyToApply(u.syncDirManifestBuilder(dir))
 		if err != nil {
-			u.log.Errorf("isReadyToApply failed on %v: %v", dir.LocalPath, err)
+			u.errorf("isReadyToApply failed on %v: %v", dir.LocalPath, err)
 			return
 		}
 		if isReady {
 			ready = append(ready, dir)
 		}
 	}
+	held := map[*SyncDir]string{}
+	if !ignoreWindows {
+		ready, held = u.holdBackForWindow(ready, time.Now())
+	}
+	ready, heldUncoupled := u.holdBackUncoupled(ready)
+	for dir, reason := range heldUncoupled {
+		held[dir] = reason
+	}
+	for dir, reason := range held {
+		u.log.Infof("Not applying %v yet. %v", dir.LocalPathNext, reason)
+	}
 	if len(ready) == 0 {
 		return
 	}
+	u.applyDirs(ready)
+}
+
+// Stop services, mirror each of 'dirs' from LocalPathNext onto LocalPath, and start services again.
+// The caller must already have checked that the staged content is consistent.
+// All of the dirs are treated as one transaction: if any of them fails to mirror, then all of them
+// are restored from their snapshots before services are started again. See transaction.go.
+func (u *Updater) applyDirs(dirs []*SyncDir) error {
+	u.applyLock.Lock()
+	defer u.applyLock.Unlock()
+
+	// Space may have run out since the release was staged
+	txn := u.newApplyTransaction(dirs)
+	if err := u.checkInstallSpace(dirs, txn.snapshots); err != nil {
+		u.errorf("Cannot apply: %v", err)
+		txn.finish(u, JournalAborted, err)
+		return err
+	}
+
+	// Archive and snapshot before stopping services, so that we don't extend the downtime
+	for _, dir := range dirs {
+		if err := u.archiveCurrent(dir); err != nil {
+			u.log.Warnf("Failed to archive %v, so it will not be possible to roll back to it: %v", dir.LocalPath, err)
+		}
+	}
+	if txn.snapshots {
+		for _, dir := range dirs {
+			if err := u.snapshotDir(dir); err != nil {
+				u.errorf("Cannot apply, failed to snapshot %v: %v", dir.LocalPath, err)
+				txn.finish(u, JournalAborted, err)
+				return err
+			}
+		}
+	}
 
 	if u.beforeSync != nil {
-		err := u.beforeSync(u, ready)
+		err := u.beforeSync(u, dirs)
 		if err != nil {
-			u.log.Errorf("Cannot apply, beforeSync error: %v", err)
-			return
+			u.errorf("Cannot apply, beforeSync error: %v", err)
+			txn.finish(u, JournalAborted, err)
+			return err
 		}
 	}
 
-	for _, dir := range ready {
+	var mirrorErr error
+	for i, dir := range dirs {
 		u.log.Infof("Mirroring %v to %v", dir.LocalPathNext, dir.LocalPath)
 		msg, err := u.mirrorNextToCurrent(dir)
 		if err != nil {
-			u.log.Errorf("error mirroring %v to %v: %v", dir.LocalPathNext, dir.LocalPath, err)
+			u.errorf("error mirroring %v to %v: %v", dir.LocalPathNext, dir.LocalPath, err)
 			u.log.Errorf("stdout from shell mirror: %v", msg)
-			return
+			mirrorErr = err
+			outcome := JournalFailed
+			if txn.snapshots {
+				outcome = u.restoreSnapshots(dirs[:i+1])
+			}
+			txn.finish(u, outcome, err)
+			break
 		}
 		u.log.Info("Mirror successful")
 	}
+	if mirrorErr == nil {
+		txn.finish(u, JournalApplied, nil)
+		u.updateState(func(s *State) {
+			for _, dir := range dirs {
+				s.dir(dir).LastApply = time.Now().UTC()
+				s.dir(dir).LastApplyHash = readHashFile(dir.LocalPath)
+			}
+		})
+	}
 
 	if u.afterSync != nil {
-		u.afterSync(u, ready)
+		u.afterSync(u, dirs, mirrorErr == nil)
 	}
+	return mirrorErr
 }
 
 func (u *Updater) mirrorNextToCurrent(syncDir *SyncDir) (string, error) {
-	return shellMirrorDirectory(syncDir.LocalPathNext, syncDir.LocalPath)
+	return u.mirrorOnto(syncDir, syncDir.LocalPathNext)
+}
+
+// Mirror srcDir onto LocalPath, leaving the local-only files in LocalPath alone
+func (u *Updater) mirrorOnto(syncDir *SyncDir, srcDir string) (string, error) {
+	release, err := ReadManifest(srcDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	excludeFiles, excludeDirs, err := syncDir.ignoreRules(release).mirrorExcludes(syncDir.LocalPath)
+	if err != nil {
+		return "", err
+	}
+	return u.mirrorDirectory(srcDir, syncDir.LocalPath, excludeFiles, excludeDirs)
+}
+
+// Returns the Source that syncDir is downloaded from.
+// Remote paths that are relative to DeployUrl are spread over Config.Mirrors, if there are any.
+// If we have LAN peers, then they are tried first for every file.
+func (u *Updater) source(syncDir *SyncDir) (Source, error) {
+	var src Source
+	if len(u.Config.Mirrors) != 0 && IsRelativeRemotePath(syncDir.Remote.Path) {
+		src = u.newMirrorSource(syncDir.Remote)
+	} else {
+		var err error
+		if src, err = newSource(u.Config, syncDir.Remote, u.httpClient); err != nil {
+			return nil, err
+		}
+		if hs, ok := src.(*httpSource); ok {
+			hs.conditional = u.conditional
+		}
+	}
+	if len(u.Config.Peers) != 0 {
+		src = &peeredSource{
+			Source: src,
+			peers:  u.Config.Peers,
+			client: u.peerClient,
+			u:      u,
+		}
+	}
+	return src, nil
 }
 
-func (u *Updater) downloadHash(syncDir *SyncDir) {
-	url := u.Config.DeployUrl + "/" + syncDir.Remote.Path + "/" + ManifestFilename_Hash
-	err := u.download_file_http(url, path.Join(syncDir.LocalPathNext, ManifestFilename_Hash))
+func (u *Updater) downloadHash(syncDir *SyncDir, src Source) error {
+	err := downloadFile(src, ManifestFilename_Hash, path.Join(syncDir.LocalPathNext, ManifestFilename_Hash))
 	if err != nil {
-		u.log.Warnf("Failed to fetch hash: %v", err)
+		u.warnf("Failed to fetch hash: %v", err)
 	}
+	return err
 }
 
-func (u *Updater) downloadContent(syncDir *SyncDir) {
-	if err := u.downloadContentHttp(syncDir); err != nil {
-		u.log.Warnf("Error synchronizing via http: %v", err)
+func (u *Updater) downloadContent(syncDir *SyncDir, src Source) error {
+	err := u.downloadContentFromSource(syncDir, src)
+	if err != nil {
+		u.warnf("Error synchronizing from %v: %v", syncDir.Remote.Path, err)
 	}
+	return err
 }
 
 /*
@@ -182,135 +363,179 @@ are identical. This saves a lot of read bandwidth when performing an incremental
 Because we leave 'next' intact from one update to the next, both directories tend to have
 very similar content. The bottom line is that updates touch only what they need to.
 
-Throughout this function we use two words:
+Throughout this function and planStaging we use two words:
 actual	The files and hashes on disk
 ideal	The files and hashes specified in a JSON manifest file
 */
-func (u *Updater) downloadContentHttp(syncDir *SyncDir) error {
-	baseUrl := u.Config.DeployUrl + "/" + syncDir.Remote.Path
+func (u *Updater) downloadContentFromSource(syncDir *SyncDir, src Source) error {
 	// Download the manifest
-	err := u.download_file_http(baseUrl+"/"+ManifestFilename_Content, path.Join(syncDir.LocalPathNext, ManifestFilename_Content))
+	err := downloadFile(src, ManifestFilename_Content, path.Join(syncDir.LocalPathNext, ManifestFilename_Content))
 	if err != nil {
 		return err
 	}
-	// Ensure manifest and hash are consistent (ie the two files manifest.content and manifest.hash)
+	// Ensure manifest and hash are consistent (ie the two files manifest.content and manifest.hash).
+	// If they are not, then we may have read a stale compressed sibling of manifest.content.
 	if err = isManifestPairConsistent(syncDir.LocalPathNext); err != nil {
-		return err
-	}
-	// Do not attempt to use an old manifest file. Always build the manifest of our old contents from the content itself.
-	actual_manifest_prev, err := BuildManifest(syncDir.LocalPath)
-	if err != nil {
-		return err
+		if retried, errRetry := downloadFileUncompressed(src, ManifestFilename_Content, path.Join(syncDir.LocalPathNext, ManifestFilename_Content)); retried && errRetry == nil {
+			err = isManifestPairConsistent(syncDir.LocalPathNext)
+		}
+		if err != nil {
+			return err
+		}
 	}
 	// Read the 'next' manifest from file
 	ideal_manifest_next, err := ReadManifest(syncDir.LocalPathNext)
 	if err != nil {
 		return err
 	}
-	n_existing := 0
-	n_ready := 0
-	n_new := 0
-	n_removed := 0
-	n_removed_dir := 0
-	bytes_downloaded := 0
-
-	// Delete files not present in 'next' manifest
-	actual_manifest_next, err := BuildManifest(syncDir.LocalPathNext)
+	plan, err := u.planStaging(syncDir, ideal_manifest_next)
 	if err != nil {
 		return err
 	}
-	nameToFile := ideal_manifest_next.nameToFileMap()
-	for _, file := range actual_manifest_next.Files {
-		if nameToFile[file.Name] == nil {
-			fullName := path.Join(syncDir.LocalPathNext, file.Name)
-			u.log.Debugf("Deleting %v", fullName)
-			if err := os.Remove(fullName); err != nil {
-				return err
-			}
-			n_removed++
-		}
+	if err := u.checkStagingSpace(syncDir, plan); err != nil {
+		return err
 	}
+	return u.executeStaging(syncDir, src, ideal_manifest_next, plan)
+}
 
-	// Delete directories not present in 'next' manifest
-	nameToDir := ideal_manifest_next.nameToDirMap()
-	for _, dir := range actual_manifest_next.Dirs {
-		if !nameToDir[dir] {
-			fullName := path.Join(syncDir.LocalPathNext, dir)
-			u.log.Debugf("Deleting directory %v", fullName)
-			if err := os.RemoveAll(fullName); err != nil {
-				return err
-			}
-			n_removed_dir++
+// Carry out 'plan', which turns LocalPathNext into an image of 'ideal'
+func (u *Updater) executeStaging(syncDir *SyncDir, src Source, ideal *Manifest, plan *StagingPlan) error {
+	n_new := 0
+	bytes_downloaded := int64(0)
+
+	// Delete files and directories not present in 'next' manifest
+	for _, name := range plan.Delete {
+		fullName := path.Join(syncDir.LocalPathNext, name)
+		u.log.Debugf("Deleting %v", fullName)
+		if err := os.Remove(fullName); err != nil {
+			return err
+		}
+	}
+	for _, dir := range plan.DeleteDirs {
+		fullName := path.Join(syncDir.LocalPathNext, dir)
+		u.log.Debugf("Deleting directory %v", fullName)
+		if err := os.RemoveAll(fullName); err != nil {
+			return err
 		}
 	}
 
 	// Create directories in 'next' manifest
-	for _, dir := range ideal_manifest_next.Dirs {
+	for _, dir := range plan.CreateDirs {
 		fullName := path.Join(syncDir.LocalPathNext, dir)
-		if _, err := os.Stat(fullName); err != nil {
-			u.log.Debugf("Creating directory %v", fullName)
-			if err := u.ensureDirExists(fullName); err != nil {
-				return err
-			}
+		u.log.Debugf("Creating directory %v", fullName)
+		if err := u.ensureDirExists(fullName); err != nil {
+			return err
 		}
 	}
 
-	// Retrieve (via copy or download) files in 'next' manifest
-	actual_hashToFilePrev := actual_manifest_prev.hashToFileMap()
-	actual_hashToFileNext := actual_manifest_next.hashToFileMap()
-	for _, file := range ideal_manifest_next.Files {
-		outFile := path.Join(syncDir.LocalPathNext, file.Name)
-		actual_prev := actual_hashToFilePrev[file.Hash]
-		actual_next := actual_hashToFileNext[file.Hash]
-		if actual_prev != nil {
-			prevFullPath := path.Join(syncDir.LocalPath, actual_prev.Name)
-			if areFileDatesAndSizesEqual(prevFullPath, outFile) {
-				u.log.Debugf("%v satisfied by %v", outFile, prevFullPath)
-				n_ready++
-			} else {
-				u.log.Debugf("Copying %v to %v", prevFullPath, outFile)
-				if err := copyFile(prevFullPath, outFile); err != nil {
-					return err
-				}
-				n_existing++
-			}
-		} else if actual_next != nil && actual_next.Name == file.Name {
-			u.log.Debugf("%v already downloaded", file.Name)
-			n_ready++
-		} else {
-			u.log.Debugf("Downloading %v", file.Name)
-			if err = u.download_file_http(baseUrl+"/"+file.Name, outFile); err != nil {
-				return err
+	// Copy files that we already have in 'current'
+	for _, c := range plan.Copy {
+		prevFullPath := path.Join(syncDir.LocalPath, c.From)
+		outFile := path.Join(syncDir.LocalPathNext, c.To)
+		u.log.Debugf("Copying %v to %v", prevFullPath, outFile)
+		if err := removeSymlink(outFile); err != nil {
+			return err
+		}
+		if err := copyFile(prevFullPath, outFile); err != nil {
+			return err
+		}
+	}
+
+	// Download the rest
+	nameToFile := ideal.nameToFileMap()
+	for _, name := range plan.Download {
+		file := nameToFile[name]
+		outFile := path.Join(syncDir.LocalPathNext, name)
+		if err := removeSymlink(outFile); err != nil {
+			return err
+		}
+		n_new++
+		if len(file.Chunks) != 0 {
+			fetched, err := u.downloadChunked(syncDir, src, file, outFile)
+			if err == nil {
+				bytes_downloaded += fetched
+				continue
 			}
-			if bytes, err := getFileSize(outFile); err != nil {
+			u.log.Warnf("Chunked download of %v failed, so downloading the whole file: %v", file.Name, err)
+		}
+		u.log.Debugf("Downloading %v", src.Describe(file.Name))
+		if err := downloadFileVerified(src, file, outFile); err != nil {
+			return err
+		}
+		size, err := getFileSize(outFile)
+		if err != nil {
+			return err
+		}
+		bytes_downloaded += size
+	}
+
+	// Set executable bits, and create symlinks. Links come last, so that their targets already exist.
+	for _, file := range ideal.Files {
+		if file.Link == "" {
+			if err := setExecBit(path.Join(syncDir.LocalPathNext, file.Name), file.Exec); err != nil {
 				return err
 			}
-			bytes_downloaded += bytes
-			n_new++
 		}
 	}
+	for _, name := range plan.Links {
+		file := nameToFile[name]
+		outFile := path.Join(syncDir.LocalPathNext, name)
+		u.log.Debugf("Linking %v to %v", outFile, file.Link)
+		if err := os.Remove(outFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(filepath.FromSlash(file.Link), outFile); err != nil {
+			return err
+		}
+		n_new++
+	}
 
-	u.log.Infof("Download complete. %v files new (%v bytes). %v files existing. %v files ready. %v files removed. %v dirs removed", n_new, bytes_downloaded, n_existing, n_ready, n_removed, n_removed_dir)
+	u.log.Infof("Download complete. %v files new (%v bytes). %v files existing. %v files ready. %v files removed. %v dirs removed", n_new, bytes_downloaded, len(plan.Copy), len(plan.Unchanged), len(plan.Delete), len(plan.DeleteDirs))
 
 	return nil
 }
 
-func (u *Updater) download_file_http(url, filename string) error {
-	res, err := u.httpClient.Get(url)
-	if err != nil {
-		return err
-	}
-	if res.StatusCode != http.StatusOK {
-		return errors.New("Error reading " + url + ": " + res.Status)
+// Remove filename if it is a symlink, so that we never write through a link that is being replaced by a real file
+func removeSymlink(filename string) error {
+	if info, err := os.Lstat(filename); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return os.Remove(filename)
 	}
+	return nil
+}
 
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
-	}
+// Log an error, and remember it so that it can be reported in the next check-in
+func (u *Updater) errorf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	u.log.Error(msg)
+	u.setLastError(msg)
+}
 
-	return ioutil.WriteFile(filename, body, newFilePerms)
+// Log a warning, and remember it so that it can be reported in the next check-in
+func (u *Updater) warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	u.log.Warn(msg)
+	u.setLastError(msg)
+}
+
+func (u *Updater) setLastError(msg string) {
+	u.errorLock.Lock()
+	defer u.errorLock.Unlock()
+	u.lastError = msg
+}
+
+func (u *Updater) getLastError() string {
+	u.errorLock.Lock()
+	defer u.errorLock.Unlock()
+	return u.lastError
+}
+
+// Forget the last error, once it has been reported. An error that came after it is kept for the next report.
+func (u *Updater) clearLastError(reported string) {
+	u.errorLock.Lock()
+	defer u.errorLock.Unlock()
+	if u.lastError == reported {
+		u.lastError = ""
+	}
 }
 
 func (u *Updater) ensureDirExists(dir string) error {
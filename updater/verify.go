@@ -0,0 +1,126 @@
+package updater
+
+// This deals with auditing an installed tree against the manifest that was installed with it.
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The difference between the files in LocalPath, and the manifest.content that was installed with them
+type Drift struct {
+	Modified []string // Files whose content, link target or executable bit has changed
+	Missing  []string // Files and dirs (with a trailing slash) that are in the manifest, but not on disk
+	Extra    []string // Files and dirs (with a trailing slash) that are on disk, but not in the manifest
+}
+
+func (d *Drift) IsEmpty() bool {
+	return len(d.Modified)+len(d.Missing)+len(d.Extra) == 0
+}
+
+func (d *Drift) WriteText(w io.Writer) {
+	for _, name := range d.Modified {
+		fmt.Fprintf(w, "modified %v\n", name)
+	}
+	for _, name := range d.Missing {
+		fmt.Fprintf(w, "missing  %v\n", name)
+	}
+	for _, name := range d.Extra {
+		fmt.Fprintf(w, "extra    %v\n", name)
+	}
+	fmt.Fprintf(w, "%v modified, %v missing, %v extra\n", len(d.Modified), len(d.Missing), len(d.Extra))
+}
+
+// Rebuild the manifest of 'dir', and compare it with the manifest.content inside it.
+// If 'dir' is the LocalPath of a SyncDir, then the ignore rules of that SyncDir apply.
+func (u *Updater) Verify(dir string) (*Drift, error) {
+	syncDir := u.Config.syncDirForLocalPath(dir)
+	if syncDir == nil {
+		syncDir = &SyncDir{LocalPath: dir}
+	}
+	recorded, err := ReadManifest(syncDir.LocalPath)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := u.buildManifestIgnoring(syncDir.LocalPath, syncDir.ignoreRules(recorded))
+	if err != nil {
+		return nil, err
+	}
+	actual.adoptReleaseInfo(recorded)
+	return driftFromDiff(DiffManifests(recorded, actual)), nil
+}
+
+// Stage the release on the remote into LocalPathNext, and install it, even if the release is
+// the same as the one that is already installed. This undoes any drift in LocalPath.
+func (u *Updater) Repair(dir string) error {
+	syncDir := u.Config.syncDirForLocalPath(dir)
+	if syncDir == nil {
+		return fmt.Errorf("%v is not the LocalPath of any synchronized directory", dir)
+	}
+	if err := u.ensureDirExists(syncDir.LocalPathNext); err != nil {
+		return err
+	}
+	src, err := u.source(syncDir)
+	if err != nil {
+		return err
+	}
+	if err := downloadFile(src, ManifestFilename_Hash, path.Join(syncDir.LocalPathNext, ManifestFilename_Hash)); err != nil {
+		return err
+	}
+	if err := u.downloadContentFromSource(syncDir, src); err != nil {
+		return err
+	}
+	if ok, err := syncDir.isStagedConsistent(u.syncDirManifestBuilder(syncDir)); err != nil {
+		return err
+	} else if !ok {
+		return ErrContentInconsistent
+	}
+	return u.applyDirs([]*SyncDir{syncDir})
+}
+
+func driftFromDiff(diff *ManifestDiff) *Drift {
+	d := &Drift{}
+	for _, f := range diff.Modified {
+		d.Modified = append(d.Modified, f.Name)
+	}
+	for _, f := range diff.Removed {
+		d.Missing = append(d.Missing, f.Name)
+	}
+	for _, f := range diff.Added {
+		d.Extra = append(d.Extra, f.Name)
+	}
+	for _, r := range diff.Renamed {
+		d.Missing = append(d.Missing, r.From)
+		d.Extra = append(d.Extra, r.To)
+	}
+	for _, dir := range diff.RemovedDirs {
+		d.Missing = append(d.Missing, dir+"/")
+	}
+	for _, dir := range diff.AddedDirs {
+		d.Extra = append(d.Extra, dir+"/")
+	}
+	return d
+}
+
+// Returns the SyncDir whose LocalPath is 'dir', or nil
+func (c *Config) syncDirForLocalPath(dir string) *SyncDir {
+	for _, s := range c.allSyncDirs() {
+		if s.LocalPath != "" && sameLocalPath(s.LocalPath, dir) {
+			return s
+		}
+	}
+	return nil
+}
+
+func sameLocalPath(a, b string) bool {
+	a = filepath.Clean(a)
+	b = filepath.Clean(b)
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
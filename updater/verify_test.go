@@ -0,0 +1,56 @@
+// +build !windows
+
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestVerifyAndRepair(t *testing.T) {
+	tmp := t.TempDir()
+	u := newTestUpdater(t, tmp)
+	u.beforeSync = nil
+	u.afterSync = nil
+	release := path.Join(tmp, "release")
+	writeTestRelease(t, release, map[string]string{
+		"a.txt":     "hello",
+		"bin/b.exe": "binary",
+	})
+	u.Config.BinDir.Remote.Path = release
+	u.Download()
+	u.Apply()
+
+	dir := u.Config.BinDir.LocalPath
+	if drift, err := u.Verify(dir); err != nil || !drift.IsEmpty() {
+		t.Fatalf("Expected no drift after install (%v, %v)", drift, err)
+	}
+
+	ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("hand edited"), 0666)
+	os.Remove(path.Join(dir, "bin/b.exe"))
+	ioutil.WriteFile(path.Join(dir, "extra.txt"), []byte("extra"), 0666)
+	ioutil.WriteFile(path.Join(dir, "site.log"), []byte("log"), 0666)
+	u.Config.BinDir.Ignore = []string{"*.log"}
+
+	drift, err := u.Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift.Modified) != 1 || drift.Modified[0] != "a.txt" ||
+		len(drift.Missing) != 1 || drift.Missing[0] != "bin/b.exe" ||
+		len(drift.Extra) != 1 || drift.Extra[0] != "extra.txt" {
+		t.Errorf("Unexpected drift %+v", drift)
+	}
+
+	if err := u.Repair(dir); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := u.Verify(dir); err != nil || !drift.IsEmpty() {
+		t.Errorf("Expected no drift after repair (%+v, %v)", drift, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "site.log")); err != nil {
+		t.Errorf("Expected repair to keep ignored file")
+	}
+}